@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default period after which an unacknowledged event is redelivered
+	ackTimeoutDefault = 30 * time.Second
+	// Default number of deliveries after which an unacknowledged event is
+	// moved to the dead-letter category
+	maxDeliveriesDefault = 5
+	// Default category that receives events whose deliveries are exhausted
+	deadLetterDefault = "dead_letter"
+)
+
+var (
+	errAckConsumer = errors.New("acknowledgement requires client_id or group")
+	errAckNotFound = errors.New("event not found or not pending acknowledgement")
+)
+
+// deliveryType records the delivery of a retained event to a consumer, that
+// is, to a consumer group or to a client that acknowledges events
+type deliveryType struct {
+	attempts int
+	// Time after which an unacknowledged event is redelivered
+	due time.Time
+	// True once the event is acknowledged, dead-lettered or, for a consumer
+	// that does not acknowledge events, delivered
+	done bool
+}
+
+// tracked returns true if deliveries to the subscriber are recorded, which is
+// the case for members of consumer groups and for subscribers that
+// acknowledge events
+func (sel selectorType) tracked() bool {
+	return sel.group != "" || sel.ack
+}
+
+// consumer returns the key under which deliveries to the subscriber are
+// recorded
+func (sel selectorType) consumer() string {
+	if sel.group != "" {
+		return "group:" + sel.group
+	}
+	return "client:" + sel.clientID
+}
+
+// record notes the delivery of a retained event to a tracked subscriber. The
+// manager mutex must be held.
+func (m *managerType) record(ent *entryType, sel selectorType, now time.Time) {
+	if ent.deliveries == nil {
+		ent.deliveries = make(map[string]*deliveryType)
+	}
+	key := sel.consumer()
+	dlv := ent.deliveries[key]
+	if dlv == nil {
+		dlv = &deliveryType{}
+		ent.deliveries[key] = dlv
+	} else {
+		m.stats.Redelivered++
+	}
+	dlv.attempts++
+	if sel.ack {
+		dlv.due = now.Add(m.opt.ackTimeout)
+	} else {
+		dlv.done = true
+	}
+}
+
+// pending reports whether a retained event is available to the specified
+// consumer. An event that has been delivered without acknowledgement becomes
+// available again when its timeout elapses, unless its deliveries are
+// exhausted, in which case exhausted is true. The manager mutex must be
+// held.
+func (m *managerType) pending(ent *entryType, key string, now time.Time) (ok, exhausted bool) {
+	dlv := ent.deliveries[key]
+	switch {
+	case dlv == nil:
+		ok = true
+	case dlv.done || now.Before(dlv.due):
+	case dlv.attempts >= m.opt.maxDeliveries:
+		exhausted = true
+	default:
+		ok = true
+	}
+	return
+}
+
+// deadLetter marks the delivery of a retained event to the specified consumer
+// as finished and returns a copy of the event for the dead-letter category.
+// The copy's metadata identifies the original category and event, the
+// consumer and the number of attempts. The manager mutex must be held.
+func (m *managerType) deadLetter(ent *entryType, key string) (evt eventType) {
+	dlv := ent.deliveries[key]
+	dlv.done = true
+	m.stats.DeadLettered++
+	evt = eventNew(m.opt.deadLetter, ent.evt.Data)
+	evt.ContentType, evt.Encoding = ent.evt.ContentType, ent.evt.Encoding
+	evt.Meta = make(map[string]string, len(ent.evt.Meta)+4)
+	for k, v := range ent.evt.Meta {
+		evt.Meta[k] = v
+	}
+	evt.Meta["original_category"] = ent.evt.Category
+	evt.Meta["original_id"] = ent.evt.ID
+	evt.Meta["consumer"] = key
+	evt.Meta["attempts"] = strconv.Itoa(dlv.attempts)
+	return
+}
+
+// sweep redelivers retained events whose acknowledgement timeout has elapsed
+// to waiting subscribers of the same consumer, and moves events whose
+// deliveries are exhausted to the dead-letter category. The manager mutex
+// must be held.
+func (m *managerType) sweep(now time.Time) {
+	var dead []eventType
+	for el := m.all.Front(); el != nil; el = el.Next() {
+		ent := el.Value.(*entryType)
+		for key := range ent.deliveries {
+			ok, exhausted := m.pending(ent, key, now)
+			if exhausted {
+				dead = append(dead, m.deadLetter(ent, key))
+			} else if ok {
+				for w := range ent.cat.waiters {
+					if ok && w.sel.ack && w.sel.consumer() == key && w.sel.match(ent.evt) {
+						w.ch <- []eventType{ent.evt}
+						delete(ent.cat.waiters, w)
+						m.record(ent, w.sel, now)
+						ok = false
+					}
+				}
+			}
+		}
+	}
+	for _, evt := range dead {
+		m.deliver(evt)
+	}
+}
+
+// redeliver sweeps periodically until the manager is shut down
+func (m *managerType) redeliver() {
+	interval := m.opt.ackTimeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			m.lock()
+			m.expire()
+			m.sweep(now)
+			m.mutex.Unlock()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// ack acknowledges the specified retained events on behalf of a consumer. An
+// error is returned if any of the events is not pending acknowledgement by
+// the consumer; the others are acknowledged nonetheless.
+func (m *managerType) ack(category string, sel selectorType, ids []string) (err error) {
+	key := sel.consumer()
+	m.lock()
+	cat := m.categories[category]
+	for _, id := range ids {
+		found := false
+		if cat != nil {
+			for el := cat.events.Front(); el != nil && !found; el = el.Next() {
+				ent := el.Value.(*entryType)
+				if ent.evt.ID == id {
+					found = true
+					if dlv := ent.deliveries[key]; dlv != nil && !dlv.done {
+						dlv.done = true
+					} else {
+						err = errAckNotFound
+					}
+				}
+			}
+		}
+		if !found {
+			err = errAckNotFound
+		}
+	}
+	m.mutex.Unlock()
+	return
+}
+
+// ackHandle responds to a request at the acknowledgement path. The form
+// fields "category" and "id" identify the events, and "group" or "client_id"
+// the consumer, as for the subscription. Several identifiers can be given by
+// repeating the "id" field or by separating them with commas.
+func (m *managerType) ackHandle(w http.ResponseWriter, r *http.Request) (err error) {
+	var ids []string
+	code := http.StatusOK
+	err = r.ParseForm()
+	if err == nil {
+		sel := selectorType{clientID: r.Form.Get("client_id"), group: r.Form.Get("group"), ack: true}
+		for _, str := range r.Form["id"] {
+			for _, id := range strings.Split(str, ",") {
+				if id = strings.TrimSpace(id); id != "" {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if sel.clientID == "" && sel.group == "" {
+			err = errAckConsumer
+		} else {
+			err = m.ack(r.Form.Get("category"), sel, ids)
+			if err != nil {
+				code = http.StatusNotFound
+			}
+		}
+	}
+	if err != nil && code == http.StatusOK {
+		code = http.StatusBadRequest
+	}
+	textRespond(w, code, err)
+	return
+}
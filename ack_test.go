@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAck(t *testing.T) {
+	var err error
+
+	m := managerGet(t, optionsType{ackTimeout: 50 * time.Millisecond, maxDeliveries: 2, deadLetter: "dl"})
+	defer m.shutdown()
+	get := func(query string) (evts []eventType, err error) {
+		var res eventResponseType
+		rec := httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&"+query, nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		evts = res.Events
+		return
+	}
+	var evts []eventType
+	var id string
+	_, err = m.publish("orders", "one")
+	if err == nil {
+		evts, err = get("category=orders&client_id=c1&ack=true")
+		if err == nil && len(evts) != 1 {
+			err = fmt.Errorf("expected 1 event, got %d", len(evts))
+		}
+	}
+	if err == nil {
+		// The unacknowledged event is redelivered to the waiting client once
+		// its timeout elapses
+		id = evts[0].ID
+		evts, err = get("category=orders&client_id=c1&ack=true")
+		if err == nil && (len(evts) != 1 || evts[0].ID != id) {
+			err = fmt.Errorf("expected redelivery, got %+v", evts)
+		}
+	}
+	if err == nil {
+		// After the second delivery, the event moves to the dead-letter category
+		evts, err = get("category=dl&since_time=0")
+		if err == nil && (len(evts) != 1 || evts[0].Data != "one" || evts[0].Meta["original_id"] != id ||
+			evts[0].Meta["consumer"] != "client:c1" || evts[0].Meta["attempts"] != "2") {
+			err = fmt.Errorf("unexpected dead letter %+v", evts)
+		}
+	}
+	if err == nil {
+		var out eventType
+		out, err = m.publish("tasks", "two")
+		if err == nil {
+			evts, err = get("category=tasks&group=workers&ack=1")
+		}
+		if err == nil {
+			err = m.ack("tasks", selectorType{group: "workers", ack: true}, []string{out.ID})
+		}
+		if err == nil {
+			m.mutex.Lock()
+			m.sweep(time.Now().Add(time.Hour))
+			m.mutex.Unlock()
+			if st := m.snapshot(); st.DeadLettered != 1 || st.Redelivered != 1 {
+				err = fmt.Errorf("unexpected statistics %+v", st)
+			}
+		}
+		if err == nil && m.ack("tasks", selectorType{group: "workers", ack: true}, []string{out.ID}) != errAckNotFound {
+			err = fmt.Errorf("expected repeated acknowledgement to fail")
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAckHandle(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	ack_path /ack
+	ack_timeout 10s
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		rec := httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/publish?category=a&body=x", nil))
+		id := rec.Header().Get("Pubsub-Id")
+		rec = httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=a&client_id=c&ack=true", nil))
+		list := []struct {
+			content string
+			code    int
+		}{
+			{"category=a&id=" + id, http.StatusBadRequest},
+			{"category=a&client_id=c&id=unknown", http.StatusNotFound},
+			{"category=a&client_id=c&id=" + id, http.StatusOK},
+			{"category=a&client_id=c&id=" + id, http.StatusNotFound},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			req := httptest.NewRequest("POST", "/ack", strings.NewReader(list[j].content))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec = httptest.NewRecorder()
+			hnd.ServeHTTP(rec, req)
+			if rec.Code != list[j].code {
+				err = fmt.Errorf("%s: expected status %d, got %d", list[j].content, list[j].code, rec.Code)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Encoding of an event body that holds binary data
+	encodingBase64 = "base64"
+	// Maximum length of a content type
+	contentTypeLenMax = 128
+	// Maximum size of a raw publication body if the block does not set one;
+	// this matches the limit net/http imposes on form bodies
+	bodyRawMax = 10 << 20
+)
+
+var (
+	errEncoding    = errors.New("publication encoding must be \"base64\" if specified")
+	errBase64      = errors.New("publication body is not valid base64")
+	errContentType = errors.New("publication content type is malformed")
+)
+
+// mediaTextual returns true if a body of the specified media type is text
+// that can be carried in a JSON string without encoding. An empty media type
+// is taken to be text.
+func mediaTextual(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+		return false
+	case strings.HasPrefix(mt, "text/"), strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// contentTypeCheck returns an error if the specified content type, supplied
+// by a publisher, is not a well-formed media type
+func contentTypeCheck(contentType string) (err error) {
+	if contentType != "" {
+		if len(contentType) > contentTypeLenMax {
+			err = errContentType
+		} else if _, _, err = mime.ParseMediaType(contentType); err != nil {
+			err = errContentType
+		}
+	}
+	return
+}
+
+// bodySet stores a body received from a publisher, broker or socket in the
+// event. A body that is not valid UTF-8 or whose media type is not textual
+// is stored as base64.
+func (evt *eventType) bodySet(body []byte, contentType string) {
+	evt.ContentType = contentType
+	if utf8.Valid(body) && mediaTextual(contentType) {
+		evt.Data = string(body)
+		evt.Encoding = ""
+	} else {
+		evt.Data = base64.StdEncoding.EncodeToString(body)
+		evt.Encoding = encodingBase64
+	}
+}
+
+// payload returns the event body as raw bytes, decoding it if it is stored
+// as base64. Binary-capable transports deliver this rather than the JSON
+// form of the event.
+func (evt eventType) payload() (buf []byte) {
+	if evt.Encoding == encodingBase64 {
+		var err error
+		buf, err = base64.StdEncoding.DecodeString(evt.Data)
+		if err == nil {
+			return
+		}
+	}
+	return []byte(evt.Data)
+}
+
+// bodySize returns the length of the event body in bytes, measuring a body
+// stored as base64 by its decoded length
+func (evt eventType) bodySize() (size int64) {
+	size = int64(len(evt.Data))
+	if evt.Encoding == encodingBase64 {
+		size = int64(base64.StdEncoding.DecodedLen(len(evt.Data)) - strings.Count(evt.Data, "="))
+	}
+	return
+}
+
+// encodingCheck returns an error if the event's encoding is not recognized
+// or its body is not valid for the encoding
+func (evt eventType) encodingCheck() (err error) {
+	switch evt.Encoding {
+	case "":
+	case encodingBase64:
+		if _, err = base64.StdEncoding.DecodeString(evt.Data); err != nil {
+			err = errBase64
+		}
+	default:
+		err = errEncoding
+	}
+	if err == nil {
+		err = contentTypeCheck(evt.ContentType)
+	}
+	return
+}
+
+// bodyRaw returns true if the body of the specified publication request is
+// the event body itself rather than form fields
+func bodyRaw(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody || (r.Method != "POST" && r.Method != "PUT") {
+		return false
+	}
+	contentType := r.Header.Get("Content-Type")
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return contentType != "" && mt != "application/x-www-form-urlencoded" && mt != "multipart/form-data"
+}
+
+// bodyGet returns the body of a publication request. A request whose
+// Content-Type is not a form type carries the body itself, with the category
+// and other fields in the query string; the body is stored as base64 if it
+// is binary, and errBodySize is returned if it exceeds bodyRawMax. Otherwise the body is the "body" form field, which holds base64
+// if the "encoding" field is "base64", and the "content_type" field supplies
+// its media type.
+func bodyGet(r *http.Request) (evt eventType, err error) {
+	if bodyRaw(r) {
+		var buf []byte
+		buf, err = ioutil.ReadAll(io.LimitReader(r.Body, bodyRawMax+1))
+		if err == nil {
+			if len(buf) > bodyRawMax {
+				err = errBodySize
+			} else {
+				evt.bodySet(buf, r.Header.Get("Content-Type"))
+			}
+		}
+	} else {
+		evt.Data = r.Form.Get("body")
+		evt.ContentType = r.Form.Get("content_type")
+		evt.Encoding = r.Form.Get("encoding")
+	}
+	if err == nil {
+		err = evt.encodingCheck()
+	}
+	return
+}
@@ -0,0 +1,201 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodySet(t *testing.T) {
+	var err error
+
+	for _, ct := range []string{"", "text/plain; charset=utf-8", "application/json", "application/ld+json"} {
+		if err == nil && !mediaTextual(ct) {
+			err = fmt.Errorf("expected %q to be textual", ct)
+		}
+	}
+	for _, ct := range []string{"image/png", "application/x-protobuf", "not a type;"} {
+		if err == nil && mediaTextual(ct) {
+			err = fmt.Errorf("expected %q to be binary", ct)
+		}
+	}
+	list := []struct {
+		body        []byte
+		contentType string
+		data        string
+		encoding    string
+	}{
+		{[]byte("hello"), "", "hello", ""},
+		{[]byte("hello"), "application/octet-stream", "aGVsbG8=", "base64"},
+		{[]byte{0xff, 0x00, 0x01}, "", "/wAB", "base64"},
+		{[]byte{0xff, 0x00, 0x01}, "text/plain", "/wAB", "base64"},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		var evt eventType
+		item := list[j]
+		evt.bodySet(item.body, item.contentType)
+		if evt.Data != item.data || evt.Encoding != item.encoding || evt.ContentType != item.contentType ||
+			!bytes.Equal(evt.payload(), item.body) {
+			err = fmt.Errorf("%d: unexpected event %+v", j, evt)
+		}
+	}
+	for _, evt := range []eventType{
+		{Data: "!!", Encoding: "base64"},
+		{Data: "abc", Encoding: "gzip"},
+		{Data: "abc", ContentType: "image/"},
+	} {
+		if err == nil && evt.encodingCheck() == nil {
+			err = fmt.Errorf("expected error for %+v", evt)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryPublish(t *testing.T) {
+	var err error
+	var dir string
+	var hnd handlerType
+	var res eventResponseType
+	var buf []byte
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	thumb := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff}
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	exec thumbs sh -c "cat > $0" `+out+`
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		list := []struct {
+			url, contentType, body string
+			code                   int
+		}{
+			{"/publish?category=thumbs&meta.camera=3", "image/png", string(thumb), 200},
+			{"/publish", "application/x-www-form-urlencoded", "category=thumbs&encoding=base64&content_type=image/png&body=" +
+				strings.Replace(base64.StdEncoding.EncodeToString(thumb), "+", "%2B", -1), 200},
+			{"/publish?category=notes", "text/plain", "plain text", 200},
+			{"/publish", "application/x-www-form-urlencoded", "category=thumbs.bad&encoding=base64&body=!!", 400},
+			{"/publish", "application/x-www-form-urlencoded", "category=thumbs.bad&encoding=gzip&body=abc", 400},
+			{"/publish?category=thumbs.bad", "image/png", "", 400},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			item := list[j]
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", item.url, strings.NewReader(item.body))
+			req.Header.Set("Content-Type", item.contentType)
+			hnd.ServeHTTP(rec, req)
+			if rec.Code != item.code {
+				err = fmt.Errorf("%d: unexpected response %d %s", j, rec.Code, rec.Body.String())
+			}
+		}
+	}
+	if err == nil {
+		var notes eventResponseType
+		rec := httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=thumbs&since_time=0", nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil {
+			rec = httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=notes&since_time=0", nil))
+			err = json.Unmarshal(rec.Body.Bytes(), &notes)
+		}
+		if err == nil && (len(res.Events) != 2 || len(notes.Events) != 1) {
+			err = fmt.Errorf("expected 2 and 1 events, got %d and %d", len(res.Events), len(notes.Events))
+		}
+		for j := 0; j < 2 && err == nil; j++ {
+			evt := res.Events[j]
+			buf, err = base64.StdEncoding.DecodeString(evt.Data)
+			if err == nil && (evt.Encoding != "base64" || evt.ContentType != "image/png" || !bytes.Equal(buf, thumb)) {
+				err = fmt.Errorf("%d: unexpected event %+v", j, evt)
+			}
+		}
+		if err == nil && (res.Events[0].Meta["camera"] != "3" || notes.Events[0].Encoding != "" ||
+			notes.Events[0].Data != "plain text") {
+			err = fmt.Errorf("unexpected events %+v %+v", res.Events, notes.Events)
+		}
+	}
+	if err == nil {
+		// The exec sink receives the raw body
+		for j := 0; j < 100 && !bytes.Equal(buf, thumb); j++ {
+			time.Sleep(10 * time.Millisecond)
+			buf, _ = ioutil.ReadFile(out)
+		}
+		if !bytes.Equal(buf, thumb) {
+			err = fmt.Errorf("unexpected exec input %q", buf)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBinaryBodySize(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	max_body_size 100
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		// A binary body is measured by its raw size, not by its base64
+		// encoding
+		for _, item := range []struct {
+			size, code int
+		}{
+			{90, 200},
+			{100, 200},
+			{101, 413},
+		} {
+			if err == nil {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest("POST", "/publish?category=thumbs", bytes.NewReader(make([]byte, item.size)))
+				req.Header.Set("Content-Type", "image/png")
+				hnd.ServeHTTP(rec, req)
+				if rec.Code != item.code {
+					err = fmt.Errorf("%d bytes: unexpected response %d %s", item.size, rec.Code, rec.Body.String())
+				}
+			}
+		}
+	}
+	if err == nil {
+		// Without a configured limit, a raw body is still bounded
+		hnd, err = handlerGet(`pubsub /publish /subscribe`, "./test")
+		if err == nil {
+			defer hnd.shutdown()
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/publish?category=thumbs", bytes.NewReader(make([]byte, bodyRawMax+1)))
+			req.Header.Set("Content-Type", "image/png")
+			hnd.ServeHTTP(rec, req)
+			if rec.Code != 413 {
+				err = fmt.Errorf("unexpected response %d %s", rec.Code, rec.Body.String())
+			}
+		}
+	}
+	for _, size := range []int{0, 1, 2, 3, 90} {
+		var evt eventType
+		if err == nil {
+			evt.bodySet(make([]byte, size), "image/png")
+			if evt.bodySize() != int64(size) {
+				err = fmt.Errorf("expected body size %d, got %d", size, evt.bodySize())
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// Default size below which a response is sent uncompressed
+	compressMinSizeDefault = 1024
+	// Default compression level
+	compressLevelDefault = 6
+)
+
+// compressType configures the compression of subscription responses
+type compressType struct {
+	// Responses smaller than this are sent uncompressed
+	minSize int64
+	// Compression level, 1 (fastest) through 9 (smallest)
+	level int
+}
+
+// compressParse parses the arguments of a compress subdirective, options of
+// the form key=value
+func compressParse(args []string) (cmp *compressType, err error) {
+	cmp = &compressType{minSize: compressMinSizeDefault, level: compressLevelDefault}
+	err = optionsParse(args, func(key, val string) (err error) {
+		switch key {
+		case "min_size":
+			cmp.minSize, err = byteSizeParse(val)
+		case "level":
+			cmp.level, err = strconv.Atoi(val)
+			if err != nil || cmp.level < 1 || cmp.level > 9 {
+				err = fmt.Errorf("compress level must be 1-9")
+			}
+		default:
+			err = fmt.Errorf("unrecognized compress option \"%s\"", key)
+		}
+		return
+	})
+	if err != nil {
+		cmp = nil
+	}
+	return
+}
+
+// encodingNegotiate returns the content coding preferred by the specified
+// Accept-Encoding header: "br", "gzip" or, if neither is acceptable, an empty
+// string. Brotli wins a tie.
+func encodingNegotiate(accept string) (coding string) {
+	q := map[string]float64{}
+	for _, item := range strings.Split(accept, ",") {
+		// A coding has the syntax of a media type without a subtype
+		name, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err == nil {
+			val := 1.0
+			if str, ok := params["q"]; ok {
+				val, err = strconv.ParseFloat(str, 64)
+			}
+			if err == nil {
+				q[name] = val
+			}
+		}
+	}
+	best := 0.0
+	for _, name := range []string{"br", "gzip"} {
+		val, ok := q[name]
+		if !ok {
+			val = q["*"]
+		}
+		if val > best {
+			coding, best = name, val
+		}
+	}
+	return
+}
+
+// flushWriter is a compressor that can send what it has compressed so far
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriterType compresses a response with the negotiated coding. The
+// response is buffered until it reaches the minimum size, so that small
+// responses are sent as they are, or until it is flushed, so that streams
+// are compressed from the start.
+type compressWriterType struct {
+	http.ResponseWriter
+	cmp    *compressType
+	coding string
+	code   int
+	buf    bytes.Buffer
+	// Nil until the response is compressed
+	zw      flushWriter
+	decided bool
+}
+
+// compressWriter returns a writer that compresses the response to the
+// specified request if the block compresses responses, the category is not
+// excluded and the client accepts a supported coding. Otherwise, the writer
+// passes the response through unchanged. Its finish method must be called
+// after the response is written.
+func (rule *ruleType) compressWriter(w http.ResponseWriter, r *http.Request, category string) (cw *compressWriterType) {
+	cw = &compressWriterType{ResponseWriter: w}
+	if rule.compress != nil {
+		for _, pattern := range rule.noCompress {
+			if globMatch(pattern, category) {
+				return
+			}
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw.cmp = rule.compress
+		cw.coding = encodingNegotiate(r.Header.Get("Accept-Encoding"))
+	}
+	return
+}
+
+// WriteHeader satisfies the http.ResponseWriter interface. The status is
+// held until it is known whether the response is compressed.
+func (cw *compressWriterType) WriteHeader(code int) {
+	if cw.coding == "" || cw.decided {
+		cw.ResponseWriter.WriteHeader(code)
+	} else if cw.code == 0 {
+		cw.code = code
+	}
+}
+
+// Write satisfies the http.ResponseWriter interface
+func (cw *compressWriterType) Write(p []byte) (count int, err error) {
+	switch {
+	case cw.coding == "":
+		count, err = cw.ResponseWriter.Write(p)
+	case cw.zw != nil:
+		count, err = cw.zw.Write(p)
+	case cw.decided:
+		count, err = cw.ResponseWriter.Write(p)
+	default:
+		count, _ = cw.buf.Write(p)
+		if int64(cw.buf.Len()) >= cw.cmp.minSize {
+			err = cw.decide(true)
+		}
+	}
+	return
+}
+
+// Flush satisfies the http.Flusher interface. The first flush of a response
+// that is still buffered starts compression regardless of its size.
+func (cw *compressWriterType) Flush() {
+	if cw.coding != "" && !cw.decided {
+		cw.decide(true)
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if fl, ok := cw.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// decide sends the response header, compressed or not, followed by the
+// buffered part of the response
+func (cw *compressWriterType) decide(compress bool) (err error) {
+	cw.decided = true
+	hdr := cw.Header()
+	if compress && hdr.Get("Content-Encoding") == "" {
+		hdr.Set("Content-Encoding", cw.coding)
+		hdr.Del("Content-Length")
+		if cw.coding == "br" {
+			cw.zw = brotli.NewWriterLevel(cw.ResponseWriter, cw.cmp.level)
+		} else {
+			cw.zw, _ = gzip.NewWriterLevel(cw.ResponseWriter, cw.cmp.level)
+		}
+	}
+	if cw.code != 0 {
+		cw.ResponseWriter.WriteHeader(cw.code)
+	}
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return
+}
+
+// finish completes the response, sending a response that is still buffered
+// uncompressed
+func (cw *compressWriterType) finish() {
+	if cw.coding != "" && !cw.decided {
+		cw.decide(false)
+	}
+	if cw.zw != nil {
+		cw.zw.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestEncodingNegotiate(t *testing.T) {
+	var err error
+
+	for accept, coding := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"gzip, deflate, br":       "br",
+		"br;q=0.5, gzip":          "gzip",
+		"*":                       "br",
+		"*;q=0.5, br;q=0":         "gzip",
+		"gzip;q=0, br;q=0, *;q=1": "",
+	} {
+		if err == nil && encodingNegotiate(accept) != coding {
+			err = fmt.Errorf("%q: expected %q, got %q", accept, coding, encodingNegotiate(accept))
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	compress min_size=512
+	no_compress ticks.*
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		m := hnd.rules[0].manager
+		body := strings.Repeat(`{"sensor":"kitchen","temp":21.5}`, 4)
+		for j := 0; j < 20 && err == nil; j++ {
+			for _, category := range []string{"bulk", "ticks.fast"} {
+				if err == nil {
+					_, err = m.publish(category, body)
+				}
+			}
+		}
+		if err == nil {
+			_, err = m.publish("small", "x")
+		}
+	}
+	list := []struct {
+		category, accept, coding string
+	}{
+		{"bulk", "gzip", "gzip"},
+		{"bulk", "gzip, br", "br"},
+		{"bulk", "", ""},
+		{"ticks.fast", "gzip, br", ""},
+		{"small", "gzip, br", ""},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		var res eventResponseType
+		var rd io.Reader
+		var buf []byte
+		item := list[j]
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/subscribe?timeout=1&since_time=0&category="+item.category, nil)
+		if item.accept != "" {
+			r.Header.Set("Accept-Encoding", item.accept)
+		}
+		hnd.ServeHTTP(rec, r)
+		if rec.Header().Get("Content-Encoding") != item.coding {
+			err = fmt.Errorf("%d: expected coding %q, got %q", j, item.coding, rec.Header().Get("Content-Encoding"))
+		}
+		if err == nil {
+			switch item.coding {
+			case "gzip":
+				rd, err = gzip.NewReader(rec.Body)
+			case "br":
+				rd = brotli.NewReader(rec.Body)
+			default:
+				rd = rec.Body
+			}
+		}
+		if err == nil {
+			buf, err = ioutil.ReadAll(rd)
+		}
+		if err == nil {
+			err = json.Unmarshal(buf, &res)
+		}
+		if err == nil && len(res.Events) == 0 {
+			err = fmt.Errorf("%d: expected events", j)
+		}
+		if err == nil && item.category != "ticks.fast" && !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+			err = fmt.Errorf("%d: expected Vary header", j)
+		}
+	}
+	if err == nil {
+		// A flush starts compression of a response that is still buffered
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/subscribe", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		cw := hnd.rules[0].compressWriter(rec, r, "bulk")
+		io.WriteString(cw, "first")
+		cw.Flush()
+		if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+			err = fmt.Errorf("expected flushed gzip stream")
+		}
+		if err == nil {
+			var zr *gzip.Reader
+			var buf []byte
+			io.WriteString(cw, " second")
+			cw.finish()
+			zr, err = gzip.NewReader(rec.Body)
+			if err == nil {
+				buf, err = ioutil.ReadAll(zr)
+			}
+			if err == nil && string(buf) != "first second" {
+				err = fmt.Errorf("unexpected stream %q", buf)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
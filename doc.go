@@ -10,9 +10,9 @@ subscribe to published events, simply connect your web client to the
 connection, include the small, dependency-free file ps.js in your web
 application and use the non-blocking methods of a Subscriber instance.
 
-This plugin uses longpolling (specifically, golongpoll) to connect
-clients to the server. The advantages of this are significant. Longpoll
-connections
+This plugin uses longpolling (with an event manager modeled on
+golongpoll) to connect clients to the server. The advantages of this are
+significant. Longpoll connections
 
 
 -   are straightforward HTTP/HTTPS
@@ -86,6 +86,109 @@ At its simplest, a publish call might look like
 In this example, the body “Hello world” is dispatched to all subscribers
 of the “team” category.
 
+The server responds with status 200 and the text “OK” when the event is
+accepted. The response headers Pubsub-Id and Pubsub-Timestamp report the
+unique identifier that was assigned to the event and the time, in
+milliseconds since the Unix epoch, at which it was dispatched. A request
+with a missing or invalid category or a missing body is rejected with
+status 400, and a request whose body is larger than the configured limit
+is rejected with status 413. In these cases the response text describes
+the problem.
+
+An event can be held by the server and dispatched later by including
+either the form field “deliver_at” or the form field “delay”. The value
+of deliver_at is the delivery time, expressed either in RFC 3339 format
+(for example, “2019-07-01T08:30:00Z”) or in milliseconds since the Unix
+epoch. The value of delay is a number of seconds or a duration such as
+“90s” or “1h30m”. For example,
+
+    https://example.com/chat/publish?category=team&body=Stand-up%20time&delay=15m
+
+A scheduled event is acknowledged with the header Pubsub-Deliver-At in
+place of Pubsub-Timestamp. Its identifier can be used to cancel it
+before it is dispatched; see the schedule_path subdirective below.
+Scheduled events are held in memory only, so they are lost if the server
+is stopped or its configuration is reloaded.
+
+A client that retries a publication after a network failure cannot tell
+whether the first attempt succeeded. To avoid publishing the event
+twice, the client can include the form field “idempotency_key” with a
+unique value of up to 256 characters, such as a UUID, and use the same
+value for every attempt. If the key was used by an accepted publication
+within the idempotency window, nothing is published and the server
+responds with the receipt headers of the original event along with the
+header Pubsub-Duplicate. Keys are scoped to the authenticated user, so
+publishers cannot collide with each other’s keys, and a key that is
+reused with a different category or body is rejected with status 409.
+Keys are remembered in memory for five minutes by default; see the
+idempotency_window subdirective below.
+
+Metadata such as a correlation identifier or priority can be attached to
+an event as key/value pairs, separately from its body. Each pair is sent
+either as a form field named “meta.” followed by the key, or as a
+request header named “Pubsub-Meta-” followed by the key. For example,
+
+    https://example.com/chat/publish?category=team&body=Hello&meta.priority=high
+
+Keys are case-insensitive and are delivered in lowercase. They consist
+of up to 64 letters, digits, underscores, periods and hyphens. An event
+can carry up to 32 pairs, and each value can be up to 1024 characters
+long. A form field takes precedence over a header with the same key.
+Metadata counts toward the size of an event for the purpose of the
+buffer limits. Subscribers receive the pairs in the “meta” field of each
+event, which is omitted when an event has no metadata. See the
+publisher_meta subdirective below to record the authenticated publisher
+automatically.
+
+An event can be addressed to particular subscribers rather than to every
+subscriber of its category by including the form field “to” with the
+client identifier of a recipient. Several recipients can be listed by
+repeating the field or by separating identifiers with commas, up to 100
+in all. Only subscribers that identify themselves with one of the listed
+identifiers receive the event, and the list of recipients is not
+revealed to them. See the description of client identifiers below.
+
+Binary bodies, such as small images or protobuf messages, can be
+published by sending the body itself as the content of a POST request
+with a Content-Type other than a form type, such as “image/png”. In that
+case the category and any other fields are included in the URL. For
+example,
+
+    curl -X POST -H "Content-Type: image/png" --data-binary @thumb.png \
+      "https://example.com/chat/publish?category=camera.thumbs"
+
+A body sent this way keeps its content type. It is stored as text if it
+is valid UTF-8 and its content type is textual, such as “text/plain” or
+“application/json”, and otherwise it is stored in base64. A form
+publication can carry a binary body as well by sending the body in
+base64 along with the form field “encoding” set to “base64”, and can
+specify a content type with the form field “content_type”. Subscribers
+receive the content type in the “content_type” field of the event and,
+for a binary body, the value “base64” in the “encoding” field; both
+fields are omitted when they are empty. Webhooks receive events in the
+same JSON form. Transports that carry raw bytes, namely exec processes
+and outbound MQTT and NATS bridges, receive the decoded body, and MQTT
+and NATS messages that are not valid UTF-8 are stored in base64 when
+they are received. Schemas, filters and transform steps treat a binary
+body as one that is not valid JSON.
+
+If the request_path subdirective is configured, a client can publish an
+event and wait for a reply to it, much as it would call a remote
+service. A request to the request path takes the same form fields as a
+publication, except that it cannot be scheduled or deduplicated, plus an
+optional “timeout” field that specifies the number of seconds to wait
+(default 30, and no more than the longpoll limit). The event is
+published with two metadata values added: “reply_to”, the name of a
+category generated for the reply, and “correlation_id”, the identifier
+of the event. A subscriber that handles the request publishes its reply
+in the reply_to category with the metadata value “correlation_id” copied
+from the request. Reply categories are exempt from the category checks
+while the request is waiting. The requester receives the reply as a
+JSON-encoded event with status 200, or status 504 if no reply arrives
+before the timeout. For example,
+
+    https://example.com/chat/request?category=time&body=now&timeout=10
+
 Subscribing
 
 When the Caddy server receives a call that matches the subscribe_path
@@ -97,23 +200,144 @@ dismissed. When the longpoll instance detects that the client is no
 longer responsive it gracefully drops the client from its subscription
 list.
 
+A subscriber that needs only some of the events in a category can
+include the query parameter “filter” so that the server withholds the
+rest. A filter consists of one or more terms separated by &&, all of
+which must be satisfied. Each term has the form path, path==value or
+path!=value. The path data refers to an event body that is JSON-encoded,
+and can be followed by period-separated field names to refer to a nested
+field, for example data.host.name. The path meta. followed by a key
+refers to a metadata value. A value is a JSON literal such as "db1", 3
+or true, or otherwise is taken as plain text. A term without a
+comparison is satisfied if the path exists. For example, the filter
+
+    data.kind=="alert" && meta.priority==high
+
+selects alerts of high priority. A body that is not valid JSON never
+satisfies a data term with ==. Filters are applied by the server before
+events are sent, so they work the same for every subscription transport.
+An invalid filter is reported in the “error” field of the response.
+
+A subscriber identifies itself to receive events addressed to it with
+the query parameter “client_id”, up to 128 characters long. If it does
+not, the server assigns a random identifier. Either way, the identifier
+is reported in the Pubsub-Client-Id response header, and a client can
+send the assigned identifier in later requests. Anyone who knows a
+client identifier can claim it, so an identifier chosen by a client
+should be hard to guess. Better still, the authenticated_client_id
+subdirective ties identifiers to authenticated users.
+
+Subscribers can share the work of handling a category’s events by
+joining a consumer group with the query parameter “group”, whose value
+is a name of up to 128 characters. Each event is delivered to only one
+member of a group, and each response to a member carries at most one
+event, so that events are spread across the members that are polling.
+Retained events that no member of the group has received yet are
+delivered regardless of “since_time”, so a group works like a queue:
+events published while every member is busy are handled when a member
+next polls. Different groups, and subscribers that do not join a group,
+each receive every event independently. An event is delivered to a group
+at most once; if the member that receives it fails to handle it, the
+event is not offered to another member.
+
+By default, an event is delivered without confirmation; if a response is
+lost in transit, the subscriber never sees the events it carried. If the
+ack_path subdirective is configured, a subscriber can request
+at-least-once delivery by including the query parameter “ack” with the
+value “true” along with either “client_id” or “group”. Such a subscriber
+receives every retained event that has not been acknowledged for its
+client identifier or group, regardless of “since_time”. After handling
+an event, the subscriber sends a request to the acknowledgement path
+with the form fields “category”, “id” (the event identifier; several can
+be separated by commas) and the same “client_id” or “group”. The server
+responds with status 200 if the events were pending acknowledgement and
+404 otherwise. An event that is not acknowledged within the
+acknowledgement timeout is delivered again. Once an event has been
+delivered the maximum number of times without acknowledgement, it is
+published in the dead-letter category instead, with the metadata
+“original_category”, “original_id”, “consumer” and “attempts” added.
+Delivery is guaranteed only while the event is retained, so the buffer
+limits and time to live should allow for the acknowledgement timeout and
+retries.
+
+If presence tracking is enabled with the presence_path subdirective, a
+subscriber that supplies a client identifier can optionally describe
+itself with the query parameter “client_info”, up to 1024 characters
+long, for example with a display name. Assigned identifiers are not
+tracked. A client is considered present in a category while it has a
+subscription request in progress and for a grace period after the
+request ends, which covers the gap before its next request. When a
+client first appears in a category, or when its grace period elapses,
+the server publishes an event in the category “presence” whose body is a
+JSON object with the fields “action” (“join” or “leave”), “category”,
+“client_id” and “info”. A client that wants to follow the members of a
+single category can subscribe to “presence” with a filter such as
+data.category=="doc1". Publishers cannot publish in the “presence”
+category, and it is exempt from the category_pattern and
+max_category_length checks for subscribers.
+
+Responses are JSON by default. A subscriber can request a more compact
+encoding of the same response with the Accept header
+“application/msgpack” for MessagePack or “application/cbor” for CBOR.
+Fields have the same names and values in every encoding, except that a
+binary body is carried as a native byte string rather than in base64,
+and its “encoding” field is omitted. If the header lists several types,
+the one with the highest quality value is used, and JSON is used if none
+of them is supported. Error responses and replies from the request path
+are encoded the same way. For example,
+
+    curl -H "Accept: application/msgpack" \
+      "https://example.com/chat/subscribe?timeout=30&category=telemetry"
+
 
 Advanced Syntax
 
 The basic syntax shown above is likely all you will need to configure
-the pubsub plugin. If some control over the underlying golongpoll
-package is needed, you can use all or part of the advanced syntax shown
-here.
+the pubsub plugin. If some control over event buffering is needed, you
+can use all or part of the advanced syntax shown here.
 
     pubsub publish_path subscribe_path {
         MaxLongpollTimeoutSeconds timeout
         MaxEventBufferSize count
         EventTimeToLiveSeconds timeout
         DeleteEventAfterFirstRetrieval
+        max_category_bytes size
+        max_block_bytes size
+        max_total_bytes size
+        stats_path path
+        max_body_size size
+        max_category_length length
+        category_pattern regexp
+        schedule_path path
+        max_scheduled count
+        idempotency_window duration
+        publisher_meta [key]
+        presence_path path
+        presence_timeout duration
+        authenticated_client_id
+        ack_path path
+        ack_timeout duration
+        max_deliveries count
+        dead_letter_category category
+        request_path path
+        webhook pattern url [option=value...]
+        exec pattern [option=value...] command [args...]
+        watch path category [option=value...]
+        source exec category [option=value...] command [args...]
+        listen unix|udp address [option=value...]
+        syslog address [option=value...]
+        mqtt url [option=value...]
+        nats url [option=value...]
+        forward pattern publish_path [template]
+        transform kind args...
+        schema pattern file
+        compress [option=value...]
+        no_compress pattern
     }
 
-Any missing fields are replaced with their default values; see the
-golongpoll documentation for more details.
+Any missing fields are replaced with their default values. The first
+four subdirectives behave like the golongpoll options of the same name;
+see the golongpoll documentation for more details.
 
 The MaxLongpollTimeoutSeconds subdirective specifies the maximum number
 of seconds that the longpoll server will keep a client connection alive.
@@ -130,6 +354,497 @@ If the DeleteEventAfterFirstRetrieval subdirective is present then
 events will be deleted right after they have been dispatched to current
 subscribers.
 
+The max_category_bytes, max_block_bytes and max_total_bytes
+subdirectives limit the memory used to retain events. Each event is
+measured by the length of its category, body and metadata. The first
+limit applies to each category, the second to all categories of the
+pubsub block, and the third to all pubsub blocks in the Caddy process
+combined. The process limit is shared: it applies to every block,
+including blocks that do not set it, and if several blocks set it the
+smallest value is used. A size is a number of bytes, optionally followed
+by KB, MB or GB. When a new event would exceed a limit, the oldest
+events are evicted to make room: first from the event’s own category if
+its limit is reached, then from anywhere in the block, and finally, for
+the process limit, from any block in the process. An event that is
+larger than a limit by itself is dispatched to current subscribers but
+is not retained. By default, no byte limits are imposed.
+
+The stats_path subdirective specifies a path at which the block reports
+its activity as a JSON object. The fields “published”, “evicted”,
+“evicted_bytes”, “expired”, “redelivered”, “dead_lettered” and “invalid”
+count events since the server started; the fields “events”, “bytes”,
+“categories” and “subscribers” describe the block’s current state; and
+“total_bytes” reports the bytes retained by all pubsub blocks in the
+process. Like the publish and subscribe paths, this path should be
+protected with authorization.
+
+The max_body_size subdirective limits the size of a publication request.
+It applies both to the content of a POST request, which is rejected
+before it is read in full, and to the event body, which for a binary
+body is measured before it is encoded in base64. The size is specified
+as it is for the byte limits above. Without this subdirective, a request
+body is limited to 10 MB.
+
+The max_category_length subdirective limits the length of a category in
+bytes. It cannot exceed the default limit of 1024.
+
+The category_pattern subdirective specifies a regular expression that
+every category must match in its entirety, for example
+[a-z]+(\.[a-z]+)*. The category length limit and pattern are checked for
+both publication and subscription requests, so that clients cannot
+create arbitrary categories.
+
+The schedule_path subdirective specifies a path at which events that are
+scheduled for later delivery can be managed. A GET request returns a
+JSON object whose “scheduled” field lists the pending events in order of
+delivery time. A DELETE request with an “id” query parameter, or a POST
+request with an “id” form field, cancels the identified event. This path
+should be protected with the same authorization as the publish path.
+
+The max_scheduled subdirective limits the number of events that can be
+pending delivery at one time. The default is 1000. Pending events also
+count toward the max_block_bytes and max_total_bytes limits: retained
+events are evicted to make room for them. A scheduling request that
+exceeds the count, or whose event would exceed a byte limit even then,
+is rejected with status 503.
+
+The idempotency_window subdirective specifies how long idempotency keys
+are remembered, either as a number of seconds or as a duration such as
+“90s” or “1h”. The default is five minutes. At most 10000 keys are
+remembered per block; beyond that, the oldest keys are forgotten early.
+
+If the publisher_meta subdirective is present, the name of the user who
+was authenticated for a publication request, for example by the
+basicauth directive, is stored in the event’s metadata under the
+specified key, or under “publisher” if no key is given. A publisher
+cannot supply this key itself; such a request is rejected with status
+400, so subscribers can rely on the value. No name is stored if the
+request was not authenticated.
+
+The presence_path subdirective enables presence tracking and specifies a
+path at which the clients present in a category can be listed. A GET
+request with a “category” query parameter returns a JSON object whose
+“members” field lists the present clients, each with the fields
+“client_id”, “info” and “joined”, in the order they joined. This path
+should be protected with the same authorization as the subscribe path.
+
+The presence_timeout subdirective specifies the grace period after a
+client’s last subscription request ends before it is considered to have
+left, either as a number of seconds or as a duration such as “45s”. The
+default is 30 seconds. It should comfortably exceed the delay between a
+client’s requests, including the delay after an error.
+
+If the authenticated_client_id subdirective is present, a subscriber’s
+client identifier is the name of the user who was authenticated for the
+subscription request, for example by the basicauth directive. Any
+identifier supplied by the client is ignored, so a direct message can
+only be received by the user it is addressed to. An unauthenticated
+subscriber is assigned a random identifier.
+
+The ack_path subdirective enables acknowledgements and specifies the
+path at which subscribers acknowledge events. This path should be
+protected with the same authorization as the subscribe path. When the
+authenticated_client_id subdirective is present, the client identifier
+of an acknowledgement is also taken from the authenticated user.
+
+The ack_timeout subdirective specifies how long the server waits for an
+acknowledgement before it delivers an event again, either as a number of
+seconds or as a duration such as “90s”. The default is 30 seconds.
+
+The max_deliveries subdirective specifies how many times an event is
+delivered without acknowledgement before it is moved to the dead-letter
+category. The default is 5.
+
+The dead_letter_category subdirective names the dead-letter category
+used for acknowledgements, webhooks and exec sinks. The default is
+“dead_letter”.
+
+The request_path subdirective specifies the path at which requests that
+wait for a reply are accepted, as described in the Publishing section
+above. This path should be protected with the same authorization as the
+publish path.
+
+Each webhook subdirective delivers the events of matching categories to
+an HTTP endpoint, so that backend services can react to events without
+polling. The pattern matches a category in its entirety; within it, *
+matches any sequence of characters and ? matches any single character.
+For example, orders.* matches “orders.new” but not “orders”. Each event
+is sent in a POST request whose body is the JSON-encoded event, with the
+fields “timestamp”, “category”, “data”, “id” and “meta”, and whose
+headers include Pubsub-Id and Pubsub-Category. A response with a 2xx
+status confirms delivery. The following options can follow the URL:
+
+
+-   secret: a key with which each request is signed. The header
+Pubsub-Signature holds “sha256=” followed by the hexadecimal
+HMAC-SHA256 of the request body, which the endpoint should verify.
+
+
+-   concurrency: the maximum number of requests in progress at once
+(default 4). The limit applies to the URL rather than to the
+subdirective: webhooks that deliver to the same URL share it, and
+the smallest of their limits applies.
+
+
+-   attempts: the number of attempts to deliver each event (default 5).
+
+
+-   backoff: the delay before the first retry, which doubles with each
+further retry up to one minute (default 1 second).
+
+
+-   timeout: the time limit of each request (default 10 seconds).
+
+An event that cannot be delivered in the allowed attempts is published
+in the dead-letter category with the metadata “original_category”,
+“original_id”, “webhook”, “attempts” and “error” added. Up to 1000
+events can wait for delivery to each webhook; beyond that, events are
+dead-lettered at once. Waiting events are held in memory only. Events in
+the dead-letter category and events addressed to particular clients are
+not sent to webhooks. For example,
+
+    webhook orders.* https://backend.example.com/hook secret={$HOOK_SECRET} concurrency=2
+
+Each exec subdirective starts a local process for every event of
+matching categories, for example to run a shell script. The pattern is
+interpreted as it is for webhooks. The process receives the event body,
+decoded if it is binary, on its standard input, and its environment
+includes the server’s environment along with PUBSUB_CATEGORY, PUBSUB_ID,
+PUBSUB_TIMESTAMP, PUBSUB_CONTENT_TYPE if the event has a content type
+and, for each metadata value, a variable named PUBSUB_META_ followed by
+the key in uppercase with characters other than letters and digits
+replaced by underscores. Its output is discarded. The command is looked
+up when the configuration is loaded, and a command that cannot be found
+is a configuration error. The following options can precede the command:
+
+
+-   timeout: the time limit of each process, after which it is killed
+(default 30 seconds).
+
+
+-   concurrency: the maximum number of processes that run at once
+(default 1).
+
+An event whose process exits with an error or exceeds the time limit is
+published in the dead-letter category with the metadata
+“original_category”, “original_id”, “exec” and “error” added. As with
+webhooks, up to 1000 events can wait for a process, and events in the
+dead-letter category and events addressed to particular clients are
+skipped. The command runs with the privileges of the Caddy server, so
+the pattern should be restricted to categories that only trusted clients
+can publish. For example,
+
+    exec ops.deploy timeout=5m /usr/local/bin/deploy.sh --notify
+
+Each watch subdirective publishes an event in the specified category
+whenever the file or directory at the specified path changes, or, for a
+directory, whenever a file in it is created, written, removed or
+renamed. The event body is a JSON object with the fields “change”, one
+of “create”, “write”, “remove” or “rename”, and “path”, the absolute
+path of the changed file. The same values are included in the event
+metadata under the keys “change” and “path”. Changes to permissions are
+ignored. The following options can follow the category:
+
+
+-   debounce: the period a path must remain unchanged before its event
+is published, as a number of seconds or a duration such as “500ms”
+(default 500ms). A burst of changes to one path produces a single
+event that reports the latest change, except that a file that is
+created and then written is reported as created.
+
+
+-   recursive: if true, directories beneath the path, including ones
+created later, are watched as well (default false).
+
+Watching starts when the server starts. Events are subject to the
+limits, transforms and schemas of the block, and events that violate
+them are discarded. For example,
+
+    watch /var/spool/uploads uploads debounce=1s recursive=true
+
+The source exec subdirective runs a long-lived command while the server
+runs and publishes each non-empty line that the command writes to its
+standard output as an event in the specified category. The command’s
+standard error is discarded, and lines longer than 64 KB cause the
+command to be stopped. Its environment includes the server’s environment
+along with PUBSUB_CATEGORY. Whenever the command exits, it is restarted
+after a delay that doubles with each exit up to one minute; a command
+that ran for at least a minute is restarted after the initial delay. As
+with exec sinks, a command that cannot be found is a configuration
+error. The following option can precede the command:
+
+
+-   backoff: the initial delay before the command is restarted (default
+1 second).
+
+Lines are subject to the limits, transforms and schemas of the block,
+and lines that violate them are discarded. The command is killed when
+the server shuts down. As with exec sinks, it runs with the privileges
+of the Caddy server. For example, the following streams the server’s
+journal to subscribers of the “journal” category:
+
+    source exec journal journalctl -f -u caddy -o cat
+
+Each listen subdirective lets local programs, such as daemons and
+crontab scripts, publish events without an HTTP round trip. With
+listen unix, the server accepts connections on a Unix domain socket at
+the specified path; with listen udp, it receives datagrams at the
+specified address. Each line that is received is a record of one of two
+forms: a category, a tab character and the event body, or a JSON object
+with the fields “category”, “body” and, optionally, “content_type”,
+“encoding” and “meta”, an object of metadata strings. The JSON form can
+carry bodies that contain newlines, and binary bodies in base64 with
+“encoding” set to “base64”. A datagram can hold several records. Records
+are subject to the category and body limits of the block, and records
+that are malformed or exceed the limits are discarded without notice.
+Unix domain socket records can be up to 1 MB long. When the server
+configuration is reloaded, a listener whose network and address are
+unchanged takes over the socket of the previous configuration rather
+than binding it again; this applies to syslog listeners as well. Two
+listeners in the same configuration cannot share an address.
+
+No authentication is performed for listeners. Access to a Unix domain
+socket is governed by its file permissions, which are set with the mode
+option (default 0660). A stale socket file left by an earlier server is
+replaced. A UDP listener should be bound to a loopback address, since
+any host that can reach it can publish. For example,
+
+    listen unix /run/caddy/pubsub.sock mode=0660
+    listen udp 127.0.0.1:5140
+
+A crontab script could then publish with
+
+    printf 'cron\tbackup finished\n' | nc -U -q0 /run/caddy/pubsub.sock
+
+Each syslog subdirective receives syslog messages in RFC 5424 or RFC
+3164 format at the specified address and publishes each one as an event.
+The event body is a JSON object with the fields “facility” and
+“severity”, given by name such as “daemon” and “err”, “priority”,
+“timestamp”, “hostname”, “app_name”, “proc_id”, “msg_id”,
+“structured_data”, an object of parameter objects keyed by element ID,
+and “message”. Fields that a message lacks are omitted, and “version” is
+included for RFC 5424 messages. A message without a recognizable header
+is published with the priority of user.notice and its text as the
+message. The following options are supported:
+
+
+-   network: either “udp”, in which case each datagram is a message, or
+“tcp”, in which case messages are framed by octet counting or
+newlines (default “udp”).
+
+
+-   category: a template for the category of each event, in which
+{hostname}, {severity}, {facility} and {app_name} are replaced by
+the values of the message; a missing value is replaced by “unknown”
+(default “logs.{hostname}.{severity}”).
+
+As with listen, no authentication is performed, events are subject to
+the limits of the block and the address should not be reachable by
+untrusted hosts. For example, the following lets a browser follow the
+errors logged on host “db1” by subscribing to the category
+“logs.db1.err”:
+
+    syslog 127.0.0.1:5514 network=tcp
+
+Each mqtt subdirective bridges the block and the MQTT broker at the
+specified URL, such as tcp://127.0.0.1:1883, so that devices that speak
+MQTT and browsers that subscribe to the block can exchange events. A
+topic and its category differ only in their separators: the topic
+“sensors/kitchen/temp” corresponds to the category
+“sensors.kitchen.temp”. The following options are supported:
+
+
+-   in: an MQTT topic filter; messages that the broker receives on
+matching topics are published as events in the corresponding
+categories. The topic is included in the event metadata under the
+key “mqtt_topic”. This option can be repeated.
+
+
+-   out: an MQTT topic filter; events in categories whose topics match
+are published to the broker. Events that were received from a broker
+are not sent back. This option can be repeated.
+
+
+-   qos: the quality of service, 0, 1 or 2, of subscriptions and
+publications (default 0).
+
+
+-   client_id, username and password: the credentials with which to
+connect (by default, a random client ID and no user name).
+
+Filters use MQTT wildcards: “+” matches a single level and “#” matches
+any number of trailing levels. Since “#” begins a comment in a
+Caddyfile, an option that contains it must be quoted. At least one in or
+out filter is required. The bridge connects when the server starts,
+retrying every five seconds until the broker is available, and
+reconnects automatically if the connection is lost. A subscription that
+the broker refuses is requested again every second. Received messages
+are subject to the limits of the block. An event that cannot be
+published to the broker is published in the dead-letter category with
+the metadata “original_category”, “original_id”, “mqtt” and “error”
+added. For example,
+
+    mqtt tcp://127.0.0.1:1883 qos=1 in=sensors/+/temp "out=actuators/#"
+
+Each nats subdirective bridges the block and the NATS server at the
+specified URL, such as nats://127.0.0.1:4222, so that browsers can
+receive events published by backend services. Since NATS subjects, like
+categories, separate tokens with “.”, each subject corresponds to the
+category of the same name. The following options are supported:
+
+
+-   in: a NATS subject; messages on matching subjects are published as
+events in the corresponding categories. The subject is included in
+the event metadata under the key “nats_subject”. This option can be
+repeated.
+
+
+-   out: a NATS subject; events in matching categories are published on
+the corresponding subjects. Events that were received from NATS are
+not sent back. This option can be repeated, and at least one in or
+out option is required.
+
+
+-   queue: the name of a queue group with which to subscribe, so that
+each message is received by only one of several servers that share
+the name (default none).
+
+Subjects use NATS wildcards: “*” matches a single token and “>” matches
+one or more trailing tokens. Credentials, if required, are given in the
+URL. As with MQTT, the bridge connects when the server starts, retrying
+every five seconds until the NATS server is available, and reconnects
+automatically. Received messages are subject to the limits of the block,
+and an event that cannot be published is dead-lettered with the metadata
+“nats” and “error” added. For example,
+
+    nats nats://127.0.0.1:4222 in=orders.> in=inventory.*.low out=commands.>
+
+Each forward subdirective copies events of matching categories into
+another pubsub block of the same Caddy server, possibly one in a
+different site. This lets a public block and an internal block stay
+separate while selected events cross between them. The pattern is
+interpreted as it is for webhooks. The target block is identified by its
+publish path or, if several sites use the same path, by the site host
+followed by the path, for example “internal.example.com/publish”. The
+server fails to start if the target cannot be found.
+
+By default the copy keeps the original category. If a template is given,
+the copy’s category is the template with {category} replaced by the
+original category and {1}, {2} and so on replaced by the text matched by
+the first, second and subsequent “*” of the pattern. The copy keeps the
+original body and metadata, and the metadata key “forwarded_from” lists
+the blocks the event has passed through, each as its site host followed
+by its publish path. An event is never forwarded to a block it has
+already visited, so rules that forward in both directions do not loop.
+If the target block records publishers with publisher_meta, a copy keeps
+the publisher recorded by the source block under the same key; a value
+under that key that the source block did not record is removed. Copies
+are subject to the limits of the target block; a copy that is rejected
+is dead-lettered in the source block with the metadata “forward” and
+“error” added. As with webhooks, events addressed to particular clients
+and events in the dead-letter category are not forwarded. For example,
+the following publishes the order events of a public block in an
+internal block, so that an event in the category “orders.new” reaches
+the internal block in the category “shop.orders.new”:
+
+    pubsub /publish /subscribe {
+        forward orders.* /internal/publish shop.orders.{1}
+    }
+    pubsub /internal/publish /internal/subscribe
+
+Each transform subdirective adds a step to a pipeline that modifies or
+drops events before they are published, for example to keep fields sent
+by publishers you do not control from reaching browsers. The steps run
+in the order they appear. The pipeline applies to events received on the
+publish and request paths and from watches, exec sources, listeners,
+syslog, MQTT, NATS and forward rules. Fields are named as they are in
+subscription filters: “data.” followed by period-separated field names
+within a JSON-encoded body, or “meta.” followed by a metadata key. The
+kinds of step are:
+
+
+-   transform rename pattern template: replaces the category of an event
+whose category matches the pattern. The pattern and template are
+interpreted as they are for forward.
+
+
+-   transform timestamp field: sets the field to the server time in
+milliseconds since the Unix epoch.
+
+
+-   transform publisher field: sets the field to the name of the
+authenticated publisher, if any.
+
+
+-   transform redact field: removes the field.
+
+
+-   transform drop filter: drops events that match the filter
+expression.
+
+Steps that set or remove a body field leave bodies that are not JSON
+objects unchanged. When a body is modified, it is re-encoded with its
+object keys in sorted order; numbers keep their original form. The
+result of the pipeline is checked against the limits of the block. A
+publisher whose event is dropped receives a successful response with the
+header Pubsub-Dropped and no event identifier; a dropped request
+receives the status 403. For example,
+
+    transform drop data.level==debug
+    transform rename raw.* clean.{1}
+    transform redact data.password
+    transform timestamp data.received_at
+
+Each schema subdirective requires the bodies of events in categories
+that match the pattern to conform to the JSON Schema in the specified
+local file, establishing a contract between publishers and subscribers.
+The pattern is interpreted as it is for webhooks. The schema is loaded
+when the server starts, and references in it to other files are resolved
+relative to its location. If several schemas match a category, the body
+must conform to all of them. A publication that does not conform is
+rejected with the status 422 and a response that lists up to ten
+validation errors, for example
+
+    Not OK: body does not conform to the schema for "orders.*": id is required
+
+Events received from watches, exec sources, listeners, syslog, MQTT and
+NATS are validated as well and discarded if they do not conform, and
+copies made by forward rules are dead-lettered in the source block. Each
+rejection is counted in the “invalid” statistic. Validation applies to
+events after the block’s transforms, so an event renamed into a category
+is checked against that category’s schemas, and a body must conform with
+any fields that transforms add. For example,
+
+    schema orders.* /etc/caddy/schemas/order.json
+
+The compress subdirective compresses subscription responses for clients
+that accept it, which greatly reduces the size of large batches of JSON
+events. The coding is negotiated with the Accept-Encoding request
+header: Brotli (“br”) is preferred, then gzip. A response is buffered
+until it reaches a minimum size, and smaller responses are sent
+uncompressed. If a response is flushed while it is still buffered,
+compression starts at once, so that a streamed response is compressed
+from its first event and each flush reaches the client. The following
+options are supported:
+
+
+-   min_size: the size below which a response is sent uncompressed,
+specified as it is for the byte limits above (default 1KB).
+
+
+-   level: the compression level, from 1 (fastest) to 9 (smallest)
+(default 6).
+
+Each no_compress subdirective exempts the categories that match the
+pattern, which is interpreted as it is for webhooks, from compression.
+This suits categories of small, frequent events whose responses gain
+little from compression. Caddy’s own gzip directive should not be
+applied to the subscribe path of a block that compresses its responses.
+For example,
+
+    compress min_size=4KB level=5
+    no_compress ticks.*
+
 
 Running the example
 
@@ -218,8 +933,9 @@ to subscribe
 above, this is “/psdemo/subscribe”)
 
 
--   callback: this is a function that is called (with the published body
-and server timestamp) for each event of the specified category
+-   callback: this is a function that is called (with the published
+body, server timestamp, metadata object and event identifier) for
+each event of the specified category
 
 
 -   authorization: a string like “Basic c3Vic2NyaWJlOjEyMw==” that will
@@ -228,9 +944,16 @@ be sent as an authorization header.
 
 -   options: an object that contains the fields timeout (seconds,
 default 45), successDelay (milliseconds, default 10), errorDelay
-(milliseconds, default 3000), and json (boolean, true if event
-bodies are JSON-encoded and should be automatically decoded, default
-false).
+(milliseconds, default 3000), json (boolean, true if event bodies
+are JSON-encoded and should be automatically decoded, default
+false), filter (string, an expression that restricts the
+subscription to matching events as described above, default none),
+clientId (string, identifies the client for direct messages and
+presence tracking, default none), clientInfo (string, describes the
+client for presence tracking, default none), group (string, the
+consumer group to join, default none), and ackUrl (string, the
+acknowledgement path; if this is set, each event is acknowledged
+after the callback returns unless it returns false, default none).
 
 More details can be found in the comments in the ps.js file.
 
@@ -273,5 +996,19 @@ In this case, body can be any JSON-encodable value such as an array or
 an object. When subscribing to events that are published this way, it is
 convenient to set the “json” field of the options argument of
 ps.Subscriber() to true so that the event body is automatically decoded.
+
+To publish an event and wait for a reply, use
+
+    ps.request(category, url, body, authorization, callback, timeout);
+
+where url is the request_path configured in the Caddyfile, callback is a
+function that is called with the reply body and metadata object (or with
+null if no reply arrives), and timeout is the number of seconds to wait.
+A subscriber that receives the request can reply with
+
+    ps.reply(meta, url, body, authorization);
+
+where meta is the metadata object received with the request and url is
+the publish_path.
 */
 package pubsub
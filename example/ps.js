@@ -53,7 +53,9 @@ var ps = ps || {};
   //
   // fnc is called when an event is received from the server. Its first parameter
   // is the body that was sent to the server by the event publisher. The second
-  // parameter is the event's Unix timestamp.
+  // parameter is the event's Unix timestamp. The third parameter is an object
+  // that holds the event's metadata; it is empty if the publisher supplied
+  // none. The fourth parameter is the event's unique identifier.
   //
   // authStr is the string value associated with the 'Authorization' header, for
   // example,
@@ -72,6 +74,20 @@ var ps = ps || {};
   //   default 3000
   // * 'json': boolean indicating whether event bodies are JSON-encoded and
   //   should be decoded automatically, default false
+  // * 'filter': expression that restricts the subscription to matching
+  //   events, for example 'data.level==3' or 'meta.priority==high', default
+  //   none
+  // * 'clientId': identifier under which the client receives direct messages
+  //   and is reported to other clients when the server tracks presence,
+  //   default none
+  // * 'clientInfo': additional text reported along with clientId, default
+  //   none
+  // * 'group': name of a consumer group whose members share the category's
+  //   events, each event going to only one member, default none
+  // * 'ackUrl': acknowledgement path configured in the Caddyfile. If this is
+  //   set, along with 'clientId' or 'group', each event is acknowledged after
+  //   fnc returns unless fnc returns false, in which case the server
+  //   redelivers the event later. Default none
   //
   // The return object has the methods start(), isActive(), and stop().
   //
@@ -83,17 +99,38 @@ var ps = ps || {};
       return new ps.Subscriber(category, url, fnc, authStr, options);
     }
 
-    var cycle, decode, active, timeoutId, opt, sinceTime, success, err, pollUrl, poll;
+    var cycle, decode, active, timeoutId, opt, sinceTime, success, err, pollUrl, poll, ack;
 
     opt = mergeInto({
       'timeout': 45,  // in seconds
       'successDelay': 10,  // milliseconds
       'errorDelay': 3000,  // milliseconds
-      'json': false // do not automatically decode event bodies as JSON
+      'json': false, // do not automatically decode event bodies as JSON
+      'filter': '', // deliver all events of the category
+      'clientId': '', // anonymous
+      'clientInfo': '',
+      'group': '', // receive every event
+      'ackUrl': '' // do not acknowledge events
     }, options);
 
     active = false;
-    pollUrl = url + '?timeout=' + opt.timeout + '&category=' + category + '&since_time=';
+    pollUrl = url + '?timeout=' + opt.timeout + '&category=' + category;
+    if (opt.filter) {
+      pollUrl += '&filter=' + encodeURIComponent(opt.filter);
+    }
+    if (opt.group) {
+      pollUrl += '&group=' + encodeURIComponent(opt.group);
+    }
+    if (opt.clientId) {
+      pollUrl += '&client_id=' + encodeURIComponent(opt.clientId);
+      if (opt.clientInfo) {
+        pollUrl += '&client_info=' + encodeURIComponent(opt.clientInfo);
+      }
+    }
+    if (opt.ackUrl) {
+      pollUrl += '&ack=true';
+    }
+    pollUrl += '&since_time=';
     timeoutId = null;
     decode = opt.json;
 
@@ -103,10 +140,31 @@ var ps = ps || {};
       }
     };
 
+    // Acknowledge the events with the specified identifiers
+    ack = function(ids) {
+      var req, str;
+
+      str = 'category=' + encodeURIComponent(category) + '&id=' + encodeURIComponent(ids.join(','));
+      if (opt.group) {
+        str += '&group=' + encodeURIComponent(opt.group);
+      }
+      if (opt.clientId) {
+        str += '&client_id=' + encodeURIComponent(opt.clientId);
+      }
+      req = ajax();
+      req.open('POST', opt.ackUrl);
+      req.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+      if (authStr && authStr.length > 0) {
+        req.setRequestHeader('Authorization', authStr);
+      }
+      req.send(str);
+    };
+
     success = function(data) {
-      var ok;
+      var ok, ids;
 
       ok = false;
+      ids = [];
       if (data) {
         data = jsonDecode(data);
         if (data) {
@@ -119,9 +177,14 @@ var ps = ps || {};
                   body = jsonDecode(evt.data);
                   if (body !== null) evt.data = body;
                 }
-                fnc(evt.data, sinceTime);
+                if (fnc(evt.data, sinceTime, evt.meta || {}, evt.id) !== false) {
+                  ids.push(evt.id);
+                }
               }
             });
+            if (opt.ackUrl && ids.length > 0) {
+              ack(ids);
+            }
             ok = true;
           }
         }
@@ -188,6 +251,45 @@ var ps = ps || {};
       encodeURIComponent(bodyStr));
   };
 
+  // Publish an event like ps.publish and wait for a reply. urlStr corresponds
+  // to the request path in the Caddyfile. fnc is called with the reply body
+  // and metadata object when the reply arrives, or with null if no reply is
+  // received within timeout seconds (default 30).
+  ps.request = function(categoryStr, urlStr, bodyStr, authStr, fnc, timeout) {
+    var req;
+
+    req = ajax(function(data) {
+      data = jsonDecode(data);
+      fnc(data ? data.data : null, data ? data.meta || {} : {});
+    }, function(code) {
+      fnc(null, {});
+    });
+    req.open('POST', urlStr);
+    req.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    if (authStr && authStr.length > 0) {
+      req.setRequestHeader('Authorization', authStr);
+    }
+    req.send('category=' + encodeURIComponent(categoryStr) + '&body=' +
+      encodeURIComponent(bodyStr) + '&timeout=' + (timeout || 30));
+  };
+
+  // Reply to a request. meta is the metadata object of the request event as
+  // received by a subscriber. urlStr corresponds to the publish path in the
+  // Caddyfile.
+  ps.reply = function(meta, urlStr, bodyStr, authStr) {
+    var req;
+
+    req = ajax();
+    req.open('POST', urlStr);
+    req.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    if (authStr && authStr.length > 0) {
+      req.setRequestHeader('Authorization', authStr);
+    }
+    req.send('category=' + encodeURIComponent(meta.reply_to) + '&body=' +
+      encodeURIComponent(bodyStr) + '&meta.correlation_id=' +
+      encodeURIComponent(meta.correlation_id));
+  };
+
   // This function is similar to ps.publish except that the third argument will
   // be JSON-encoded.
   ps.publishObj = function(categoryStr, urlStr, bodyObj, authStr) {
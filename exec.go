@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default number of processes that run at once for an exec sink
+	execConcurrencyDefault = 1
+	// Default time limit of a process
+	execTimeoutDefault = 30 * time.Second
+)
+
+// execSinkType starts a local process for each event of matching categories
+type execSinkType struct {
+	poolType
+	pattern     string
+	command     string
+	args        []string
+	concurrency int
+	timeout     time.Duration
+}
+
+// execParse parses the arguments of an exec subdirective: a category
+// pattern, optional settings of the form key=value, and a command with its
+// arguments
+func execParse(args []string) (snk *execSinkType, err error) {
+	var j int
+	if len(args) < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"exec\", got %d", len(args))
+		return
+	}
+	snk = &execSinkType{
+		pattern:     args[0],
+		concurrency: execConcurrencyDefault,
+		timeout:     execTimeoutDefault,
+	}
+	// Settings precede the command
+	for j = 1; j < len(args) && err == nil && (strings.HasPrefix(args[j], "timeout=") ||
+		strings.HasPrefix(args[j], "concurrency=")); j++ {
+		err = optionsParse(args[j:j+1], func(key, val string) (err error) {
+			switch key {
+			case "timeout":
+				snk.timeout, err = durationParse(val)
+				if err == nil && snk.timeout <= 0 {
+					err = fmt.Errorf("exec timeout must be positive")
+				}
+			case "concurrency":
+				snk.concurrency, err = strconv.Atoi(val)
+				if err == nil && snk.concurrency < 1 {
+					err = fmt.Errorf("exec concurrency must be at least 1")
+				}
+			}
+			return
+		})
+	}
+	if err == nil {
+		if j < len(args) {
+			snk.command = args[j]
+			snk.args = args[j+1:]
+			_, err = exec.LookPath(snk.command)
+		} else {
+			err = fmt.Errorf("expecting a command after \"exec\" settings")
+		}
+	}
+	if err != nil {
+		snk = nil
+	}
+	return
+}
+
+// envName converts a metadata key to the suffix of an environment variable
+// name: letters are uppercased and other characters other than digits
+// become underscores
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// environment returns the environment of the process for the specified
+// event: the server's environment plus PUBSUB_CATEGORY, PUBSUB_ID,
+// PUBSUB_TIMESTAMP, PUBSUB_CONTENT_TYPE if the publisher supplied one and a
+// PUBSUB_META_ variable for each metadata value
+func environment(evt eventType) (env []string) {
+	env = append(os.Environ(),
+		"PUBSUB_CATEGORY="+evt.Category,
+		"PUBSUB_ID="+evt.ID,
+		"PUBSUB_TIMESTAMP="+strconv.FormatInt(evt.Timestamp, 10))
+	if evt.ContentType != "" {
+		env = append(env, "PUBSUB_CONTENT_TYPE="+evt.ContentType)
+	}
+	for key, val := range evt.Meta {
+		env = append(env, "PUBSUB_META_"+envName(key)+"="+val)
+	}
+	return
+}
+
+// start begins running processes for events dispatched by the specified
+// manager
+func (snk *execSinkType) start(m *managerType) {
+	snk.poolType.start(m, snk.concurrency, snk.run)
+}
+
+// accept satisfies the sinkType interface. If the queue is full, the event is
+// dead-lettered at once.
+func (snk *execSinkType) accept(evt eventType) {
+	if sinkAccepts(snk.manager, snk.pattern, evt) && !snk.enqueue(evt) {
+		go snk.deadLetter(evt, map[string]string{"exec": snk.command, "error": "execution queue full"})
+	}
+}
+
+// run starts a process for the specified event and waits for it to finish.
+// The event body, decoded if it is binary, is written to the process's
+// standard input; its output is discarded. A process that fails or exceeds
+// the time limit causes the event to be dead-lettered.
+func (snk *execSinkType) run(evt eventType) {
+	ctx, cancel := context.WithTimeout(context.Background(), snk.timeout)
+	defer cancel()
+	go func() {
+		// Stopping the sink ends any process in progress
+		select {
+		case <-snk.stopped():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	cmd := exec.CommandContext(ctx, snk.command, snk.args...)
+	cmd.Stdin = bytes.NewReader(evt.payload())
+	cmd.Env = environment(evt)
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("process exceeded time limit of %s", snk.timeout)
+		}
+		select {
+		case <-snk.stopped():
+		default:
+			snk.deadLetter(evt, map[string]string{"exec": snk.command, "error": err.Error()})
+		}
+	}
+}
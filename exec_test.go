@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecParse(t *testing.T) {
+	var err error
+	var snk *execSinkType
+
+	snk, err = execParse([]string{"ops.*", "timeout=5s", "concurrency=3", "sh", "-c", "level=2"})
+	if err == nil && (snk.timeout != 5*time.Second || snk.concurrency != 3 || snk.command != "sh" ||
+		strings.Join(snk.args, " ") != "-c level=2") {
+		err = fmt.Errorf("unexpected sink %+v", snk)
+	}
+	for _, args := range [][]string{
+		{"ops.*"},
+		{"ops.*", "timeout=5s"},
+		{"ops.*", "concurrency=0", "sh"},
+		{"ops.*", "no-such-command-for-pubsub"},
+	} {
+		if err == nil {
+			_, err = execParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err == nil && envName("trace-id.v2") != "TRACE_ID_V2" {
+		err = fmt.Errorf("unexpected environment name %s", envName("trace-id.v2"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	var err error
+	var dir string
+	var buf []byte
+	var res eventResponseType
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	script := `case "$PUBSUB_CATEGORY" in
+ops.slow) sleep 5 ;;
+ops.fail) exit 3 ;;
+*) printf '%s|%s|' "$PUBSUB_CATEGORY" "$PUBSUB_META_TRACE_ID" > "$0"; cat >> "$0" ;;
+esac`
+	var snk *execSinkType
+	snk, err = execParse([]string{"ops.*", "timeout=200ms", "concurrency=2", "sh", "-c", script, out})
+	if err == nil {
+		snk.start(m)
+		m.sinks = append(m.sinks, snk)
+		evt := eventNew("ops.deploy", "release 1.2")
+		evt.Meta = map[string]string{"trace-id": "t1"}
+		_, err = m.dispatch(evt)
+		for _, category := range []string{"ops.slow", "ops.fail"} {
+			if err == nil {
+				_, err = m.publish(category, "x")
+			}
+		}
+	}
+	if err == nil {
+		// Wait for both failures to be dead-lettered
+		for j := 0; j < 100 && len(res.Events) < 2; j++ {
+			rec := httptest.NewRecorder()
+			m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=dead_letter&since_time=0", nil))
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(res.Events) != 2 {
+			err = fmt.Errorf("expected 2 dead letters, got %d", len(res.Events))
+		}
+	}
+	if err == nil {
+		buf, err = ioutil.ReadFile(out)
+		if err == nil && string(buf) != "ops.deploy|t1|release 1.2" {
+			err = fmt.Errorf("unexpected output %q", buf)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
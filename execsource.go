@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// Default delay before a command that has exited is restarted
+	execSourceBackoffDefault = time.Second
+	// The restart delay doubles with each exit up to this limit. A command
+	// that runs at least this long before exiting is restarted after the
+	// initial delay.
+	execSourceBackoffMax = time.Minute
+	// Maximum length in bytes of a line of output
+	execSourceLineMax = 64 * 1024
+)
+
+// execSourceType runs a long-lived command and publishes each line it writes
+// to its standard output as an event. The command is restarted with backoff
+// whenever it exits.
+type execSourceType struct {
+	category string
+	command  string
+	args     []string
+	backoff  time.Duration
+	// Validates, transforms and dispatches lines
+	ingest func(evt eventType) error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// execSourceParse parses the arguments of an exec source: a category,
+// optional settings of the form key=value and a command with its arguments
+func execSourceParse(args []string) (src *execSourceType, err error) {
+	var j int
+	if len(args) < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"source exec\", got %d", len(args))
+		return
+	}
+	src = &execSourceType{category: args[0], backoff: execSourceBackoffDefault}
+	if len(src.category) == 0 || len(src.category) > categoryLenMax {
+		err = errCategoryLen
+	}
+	// Settings precede the command
+	for j = 1; j < len(args) && err == nil && strings.HasPrefix(args[j], "backoff="); j++ {
+		err = optionsParse(args[j:j+1], func(key, val string) (err error) {
+			src.backoff, err = durationParse(val)
+			if err == nil && src.backoff <= 0 {
+				err = fmt.Errorf("source backoff must be positive")
+			}
+			return
+		})
+	}
+	if err == nil {
+		if j < len(args) {
+			src.command = args[j]
+			src.args = args[j+1:]
+			// A command that cannot be found would otherwise be retried
+			// forever without notice
+			_, err = exec.LookPath(src.command)
+		} else {
+			err = fmt.Errorf("expecting a command after \"source exec\" settings")
+		}
+	}
+	if err != nil {
+		src = nil
+	}
+	return
+}
+
+// start satisfies the sourceType interface
+func (src *execSourceType) start(m *managerType) (err error) {
+	var ctx context.Context
+	ctx, src.cancel = context.WithCancel(context.Background())
+	src.done = make(chan struct{})
+	go src.loop(ctx)
+	return
+}
+
+// stop satisfies the sourceType interface. A running command is killed.
+func (src *execSourceType) stop() {
+	if src.cancel != nil {
+		src.cancel()
+		<-src.done
+	}
+}
+
+// loop runs the command repeatedly until the source is stopped, waiting
+// between runs for a delay that doubles each time the command exits quickly
+func (src *execSourceType) loop(ctx context.Context) {
+	defer close(src.done)
+	delay := src.backoff
+	for {
+		begin := time.Now()
+		src.run(ctx)
+		if time.Since(begin) >= execSourceBackoffMax {
+			delay = src.backoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > execSourceBackoffMax {
+			delay = execSourceBackoffMax
+		}
+	}
+}
+
+// run starts the command and publishes each non-empty line of its standard
+// output until the output ends. A line that is too long ends the run and the
+// command is killed. The command's standard error is discarded.
+func (src *execSourceType) run(ctx context.Context) (err error) {
+	var rd, wr *os.File
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rd, wr, err = os.Pipe()
+	if err == nil {
+		cmd := exec.CommandContext(ctx, src.command, src.args...)
+		cmd.Stdout = wr
+		cmd.Env = append(os.Environ(), "PUBSUB_CATEGORY="+src.category)
+		err = cmd.Start()
+		wr.Close()
+		if err == nil {
+			finished := make(chan struct{})
+			go func() {
+				// Stopping the source unblocks the reader even if processes
+				// started by the command keep the pipe open
+				select {
+				case <-ctx.Done():
+					rd.Close()
+				case <-finished:
+				}
+			}()
+			scanner := bufio.NewScanner(rd)
+			scanner.Buffer(make([]byte, 4096), execSourceLineMax)
+			for scanner.Scan() {
+				line := strings.TrimSuffix(scanner.Text(), "\r")
+				if line != "" {
+					src.ingest(eventNew(src.category, line))
+				}
+			}
+			close(finished)
+			if scanner.Err() != nil {
+				cancel()
+			}
+			err = cmd.Wait()
+		}
+		rd.Close()
+	}
+	return
+}
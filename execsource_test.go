@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecSourceParse(t *testing.T) {
+	var err error
+	var src sourceType
+
+	src, err = sourceParse([]string{"exec", "logs", "backoff=2s", "tail", "-f", "/var/log/syslog"})
+	if err == nil {
+		es, ok := src.(*execSourceType)
+		if !ok || es.category != "logs" || es.backoff != 2*time.Second || es.command != "tail" ||
+			strings.Join(es.args, " ") != "-f /var/log/syslog" {
+			err = fmt.Errorf("unexpected source %+v", src)
+		}
+	}
+	for _, args := range [][]string{
+		{},
+		{"exec", "logs"},
+		{"exec", "logs", "backoff=0", "tail"},
+		{"tail", "logs", "journalctl"},
+		{"exec", "logs", "no-such-command-for-pubsub"},
+	} {
+		if err == nil {
+			_, err = sourceParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecSource(t *testing.T) {
+	var err error
+	var src *execSourceType
+	var res eventResponseType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	// Lines that exceed the block's body limit are discarded
+	rule := ruleType{maxBodySize: 3, manager: m}
+	// The command exits after each run and is restarted
+	src, err = execSourceParse([]string{"logs", "backoff=50ms", "sh", "-c", `printf 'one\n\ntoo long\ntwo\r\n'`})
+	if err == nil {
+		src.ingest = rule.ingest
+		err = src.start(m)
+	}
+	if err == nil {
+		for j := 0; j < 100 && len(res.Events) < 4; j++ {
+			time.Sleep(10 * time.Millisecond)
+			rec := httptest.NewRecorder()
+			m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=logs&since_time=0", nil))
+			json.Unmarshal(rec.Body.Bytes(), &res)
+		}
+		src.stop()
+		if len(res.Events) < 4 {
+			err = fmt.Errorf("expected at least 4 events, got %d", len(res.Events))
+		}
+		for j := 0; j < 4 && err == nil; j++ {
+			if res.Events[j].Data != []string{"one", "two"}[j%2] {
+				err = fmt.Errorf("unexpected event %d: %q", j, res.Events[j].Data)
+			}
+		}
+	}
+	if err == nil {
+		// Stopping the source kills a command that is still running
+		src, err = execSourceParse([]string{"logs", "sh", "-c", "sleep 10"})
+		if err == nil {
+			src.ingest = rule.ingest
+			err = src.start(m)
+		}
+		if err == nil {
+			time.Sleep(50 * time.Millisecond)
+			begin := time.Now()
+			src.stop()
+			if time.Since(begin) > 5*time.Second {
+				err = fmt.Errorf("source took too long to stop")
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Maximum length of a filter expression
+const filterLenMax = 1024
+
+// filterTermType is a single comparison of a filter expression
+type filterTermType struct {
+	// True if the term refers to metadata, false if to the JSON body
+	meta bool
+	// Metadata key, or the field names leading into the JSON body
+	path []string
+	// One of "==", "!=" or, for a term that only tests presence, ""
+	op string
+	// Comparison value decoded from JSON, or the literal text if it is not
+	// valid JSON
+	val interface{}
+	// Literal text of the comparison value
+	text string
+}
+
+// filterType is a parsed filter expression. An event matches if it matches
+// every term.
+type filterType []filterTermType
+
+// filterParse parses a filter expression. The expression consists of one or
+// more terms separated by "&&". Each term has the form "path", "path==value"
+// or "path!=value". The path is either "data", optionally followed by
+// period-separated field names that lead into a JSON-encoded body, or "meta."
+// followed by a metadata key. A value is a JSON literal such as "text", 42 or
+// true, or otherwise is taken as unquoted text. A term without a comparison
+// is satisfied if the path exists. An empty expression yields a nil filter
+// that matches everything.
+func filterParse(str string) (f filterType, err error) {
+	if str == "" {
+		return
+	}
+	if len(str) > filterLenMax {
+		err = fmt.Errorf("filter must be at most %d characters long", filterLenMax)
+		return
+	}
+	list := strings.Split(str, "&&")
+	for j := 0; j < len(list) && err == nil; j++ {
+		var term filterTermType
+		var path string
+		src := strings.TrimSpace(list[j])
+		if pos := strings.Index(src, "=="); pos >= 0 {
+			term.op, path, term.text = "==", src[:pos], src[pos+2:]
+		} else if pos = strings.Index(src, "!="); pos >= 0 {
+			term.op, path, term.text = "!=", src[:pos], src[pos+2:]
+		} else {
+			path = src
+		}
+		path = strings.TrimSpace(path)
+		term.text = strings.TrimSpace(term.text)
+		if json.Unmarshal([]byte(term.text), &term.val) != nil {
+			term.val = term.text
+		}
+		term.path = strings.Split(path, ".")
+		switch {
+		case term.path[0] == "meta" && len(term.path) > 1:
+			term.meta = true
+			term.path = []string{strings.ToLower(path[len("meta."):])}
+		case term.path[0] == "data":
+			term.path = term.path[1:]
+			for k := 0; k < len(term.path) && err == nil; k++ {
+				if term.path[k] == "" {
+					err = fmt.Errorf("empty field name in filter term \"%s\"", src)
+				}
+			}
+		default:
+			err = fmt.Errorf("filter term \"%s\" must refer to data or meta", src)
+		}
+		f = append(f, term)
+	}
+	if err != nil {
+		f = nil
+	}
+	return
+}
+
+// bodyType lazily decodes the JSON body of an event so that a filter with
+// several data terms decodes it only once
+type bodyType struct {
+	data    string
+	decoded bool
+	val     interface{}
+	ok      bool
+}
+
+// get returns the decoded body and whether it is valid JSON
+func (b *bodyType) get() (interface{}, bool) {
+	if !b.decoded {
+		b.ok = json.Unmarshal([]byte(b.data), &b.val) == nil
+		b.decoded = true
+	}
+	return b.val, b.ok
+}
+
+// lookup returns the value at the specified path within the decoded body
+func (b *bodyType) lookup(path []string) (val interface{}, ok bool) {
+	val, ok = b.get()
+	for j := 0; j < len(path) && ok; j++ {
+		var obj map[string]interface{}
+		obj, ok = val.(map[string]interface{})
+		if ok {
+			val, ok = obj[path[j]]
+		}
+	}
+	return
+}
+
+// match returns true if the specified term is satisfied by the event whose
+// body is given
+func (term filterTermType) match(evt eventType, body *bodyType) (ok bool) {
+	var val interface{}
+	var eq bool
+	if term.meta {
+		var str string
+		str, ok = evt.Meta[term.path[0]]
+		if ok {
+			// Metadata values are strings, so compare a quoted literal by its
+			// content and any other literal by its text
+			if lit, isStr := term.val.(string); isStr {
+				eq = str == lit
+			} else {
+				eq = str == term.text
+			}
+		}
+	} else {
+		val, ok = body.lookup(term.path)
+		if ok {
+			eq = reflect.DeepEqual(val, term.val)
+		}
+	}
+	switch term.op {
+	case "==":
+		ok = ok && eq
+	case "!=":
+		ok = !ok || !eq
+	}
+	return
+}
+
+// match returns true if the specified event satisfies every term of the
+// filter. A binary body is treated as one that is not valid JSON.
+func (f filterType) match(evt eventType) (ok bool) {
+	body := bodyType{data: evt.Data, decoded: evt.Encoding != ""}
+	ok = true
+	for j := 0; j < len(f) && ok; j++ {
+		ok = f[j].match(evt, &body)
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	var err error
+	var f filterType
+
+	evt := eventType{
+		Data: `{"kind":"alert","level":3,"host":{"name":"db1"},"ok":false}`,
+		Meta: map[string]string{"priority": "high", "retries": "2"},
+	}
+	list := []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{`data.kind=="alert"`, true},
+		{"data.kind==alert", true},
+		{"data.level==3", true},
+		{`data.level=="3"`, false},
+		{"data.host.name==db1 && meta.priority==high", true},
+		{"data.host.name==db1 && meta.priority==low", false},
+		{"data.ok==false", true},
+		{"data.missing", false},
+		{"data.missing!=1", true},
+		{"data.host", true},
+		{"meta.Priority", true},
+		{"meta.retries==2", true},
+		{"meta.priority!=high", false},
+		{"data==1", false},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		f, err = filterParse(list[j].expr)
+		if err == nil && f.match(evt) != list[j].match {
+			err = fmt.Errorf("%s: expected match %v", list[j].expr, list[j].match)
+		}
+	}
+	if err == nil {
+		f, _ = filterParse("data.kind==alert")
+		if f.match(eventType{Data: "not json"}) {
+			err = fmt.Errorf("expected non-JSON body not to match")
+		}
+	}
+	for _, expr := range []string{"kind==alert", "data..kind", "meta", "data.a && "} {
+		if err == nil {
+			_, err = filterParse(expr)
+			if err == nil {
+				err = fmt.Errorf("%s: expected parse error", expr)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterSubscription(t *testing.T) {
+	var err error
+	var res eventResponseType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	for _, body := range []string{`{"n":1}`, `{"n":2}`, `{"n":1}`} {
+		if err == nil {
+			_, err = m.publish("demo", body)
+		}
+	}
+	if err == nil {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/subscribe?timeout=1&category=demo&since_time=0&filter="+
+			url.QueryEscape("data.n==1"), nil)
+		m.subscriptionHandler(rec, req)
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil && len(res.Events) != 2 {
+			err = fmt.Errorf("expected 2 events, got %s", rec.Body.String())
+		}
+	}
+	if err == nil {
+		// A waiting subscriber is released only by a matching event
+		done := make(chan string)
+		go func() {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/subscribe?timeout=5&category=live&filter="+
+				url.QueryEscape("meta.kind==b"), nil)
+			m.subscriptionHandler(rec, req)
+			done <- rec.Body.String()
+		}()
+		for m.snapshot().Subscribers == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		a := eventNew("live", "first")
+		a.Meta = map[string]string{"kind": "a"}
+		b := eventNew("live", "second")
+		b.Meta = map[string]string{"kind": "b"}
+		_, err = m.dispatch(a)
+		if err == nil {
+			_, err = m.dispatch(b)
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(<-done), &res)
+			if err == nil && (len(res.Events) != 1 || res.Events[0].Data != "second") {
+				err = fmt.Errorf("unexpected events %+v", res.Events)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
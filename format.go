@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// formatType is an encoding in which responses are sent to subscribers.
+// Every format carries the same envelope; struct fields are named by their
+// json tags.
+type formatType struct {
+	contentType string
+	// Encodes values; nil for JSON, which is encoded as golongpoll encodes it
+	handle codec.Handle
+}
+
+var (
+	formatJSON    = formatType{contentType: "application/json"}
+	formatMsgpack = formatType{contentType: "application/msgpack", handle: &codec.MsgpackHandle{WriteExt: true}}
+	formatCBOR    = formatType{contentType: "application/cbor", handle: &codec.CborHandle{}}
+)
+
+// formatList maps the media types that can be requested in an Accept header
+// to their formats
+var formatList = map[string]formatType{
+	"application/json":        formatJSON,
+	"application/*":           formatJSON,
+	"*/*":                     formatJSON,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+	"application/cbor":        formatCBOR,
+}
+
+// formatNegotiate returns the format preferred by the Accept header of the
+// specified request. Of the supported media types, the one with the highest
+// quality value wins, and the earlier one wins a tie. JSON is returned if
+// the header is missing or names no supported type.
+func formatNegotiate(r *http.Request) (f formatType) {
+	f = formatJSON
+	best := 0.0
+	for _, rng := range strings.Split(strings.Join(r.Header["Accept"], ","), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(rng))
+		if err == nil {
+			if g, ok := formatList[mt]; ok {
+				q := 1.0
+				if str, ok := params["q"]; ok {
+					q, err = strconv.ParseFloat(str, 64)
+				}
+				if err == nil && q > best {
+					f, best = g, q
+				}
+			}
+		}
+	}
+	return
+}
+
+// headerSet sets the Content-Type response header to the format's media type
+func (f formatType) headerSet(hdr http.Header) {
+	hdr.Set("Content-Type", f.contentType)
+}
+
+// nativeEventType is the form in which an event is encoded in formats other
+// than JSON. Data holds a string, or a byte slice if the body is binary; the
+// encoding field is then omitted since the body is no longer in base64.
+type nativeEventType struct {
+	Timestamp   int64             `json:"timestamp,omitempty"`
+	Category    string            `json:"category"`
+	Data        interface{}       `json:"data"`
+	ID          string            `json:"id"`
+	ContentType string            `json:"content_type,omitempty"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// nativeResponseType is eventResponseType in the form encoded in formats
+// other than JSON
+type nativeResponseType struct {
+	Events []nativeEventType `json:"events"`
+}
+
+// native returns the specified event in the form in which it is encoded in
+// formats other than JSON
+func native(evt eventType) (nat nativeEventType) {
+	nat = nativeEventType{
+		Timestamp:   evt.Timestamp,
+		Category:    evt.Category,
+		Data:        evt.Data,
+		ID:          evt.ID,
+		ContentType: evt.ContentType,
+		Encoding:    evt.Encoding,
+		Meta:        evt.Meta,
+	}
+	if evt.Encoding == encodingBase64 {
+		nat.Data = evt.payload()
+		nat.Encoding = ""
+	}
+	return
+}
+
+// write writes the encoding of val to w. In formats other than JSON, binary
+// event bodies are written as byte strings.
+func (f formatType) write(w io.Writer, val interface{}) {
+	if f.handle == nil {
+		writeJSON(w, val)
+	} else {
+		switch v := val.(type) {
+		case eventResponseType:
+			res := nativeResponseType{Events: make([]nativeEventType, len(v.Events))}
+			for j, evt := range v.Events {
+				res.Events[j] = native(evt)
+			}
+			val = res
+		case eventType:
+			val = native(v)
+		}
+		if err := codec.NewEncoder(w, f.handle).Encode(val); err != nil {
+			f.errorWrite(w, f.contentType[len("application/"):]+" encoder failed")
+		}
+	}
+}
+
+// errorWrite writes an object whose "error" field holds the specified
+// message
+func (f formatType) errorWrite(w io.Writer, msg string) {
+	if f.handle == nil {
+		buf, _ := json.Marshal(msg)
+		fmt.Fprintf(w, `{"error": %s}`, buf)
+	} else {
+		codec.NewEncoder(w, f.handle).Encode(map[string]string{"error": msg})
+	}
+}
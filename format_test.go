@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestFormatNegotiate(t *testing.T) {
+	var err error
+
+	list := []struct {
+		accept string
+		format formatType
+	}{
+		{"", formatJSON},
+		{"text/html, */*", formatJSON},
+		{"application/msgpack", formatMsgpack},
+		{"application/x-msgpack", formatMsgpack},
+		{"application/cbor, application/json", formatCBOR},
+		{"application/json;q=0.5, application/cbor;q=0.9", formatCBOR},
+		{"application/cbor;q=0.2, application/*;q=0.4", formatJSON},
+		{"application/msgpack;q=0", formatJSON},
+		{"application/msgpack;q=bad", formatJSON},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		r := httptest.NewRequest("GET", "/subscribe", nil)
+		if list[j].accept != "" {
+			r.Header.Set("Accept", list[j].accept)
+		}
+		if f := formatNegotiate(r); f.contentType != list[j].format.contentType {
+			err = fmt.Errorf("%q: expected %s, got %s", list[j].accept, list[j].format.contentType, f.contentType)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatSubscribe(t *testing.T) {
+	var err error
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	evt := eventNew("telemetry", "aGVsbG8=")
+	evt.ContentType, evt.Encoding = "application/octet-stream", encodingBase64
+	evt.Meta = map[string]string{"unit": "c"}
+	evt, err = m.dispatch(evt)
+	if err == nil {
+		_, err = m.publish("telemetry", "plain")
+	}
+	for _, f := range []formatType{formatMsgpack, formatCBOR} {
+		if err == nil {
+			var res nativeResponseType
+			var fail map[string]string
+			rec := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/subscribe?timeout=1&category=telemetry&since_time=0", nil)
+			r.Header.Set("Accept", f.contentType)
+			m.subscriptionHandler(rec, r)
+			if rec.Header().Get("Content-Type") != f.contentType {
+				err = fmt.Errorf("unexpected content type %s", rec.Header().Get("Content-Type"))
+			}
+			if err == nil {
+				err = codec.NewDecoderBytes(rec.Body.Bytes(), f.handle).Decode(&res)
+			}
+			if err == nil {
+				// The binary body arrives as bytes and the text body as a string
+				var bin []byte
+				if len(res.Events) > 0 {
+					bin, _ = res.Events[0].Data.([]byte)
+				}
+				if len(res.Events) != 2 || res.Events[0].ID != evt.ID || string(bin) != "hello" ||
+					res.Events[0].Timestamp != evt.Timestamp || res.Events[0].Encoding != "" ||
+					res.Events[0].Meta["unit"] != "c" || res.Events[1].Data != "plain" {
+					err = fmt.Errorf("%s: unexpected response %+v", f.contentType, res)
+				}
+			}
+			if err == nil {
+				rec = httptest.NewRecorder()
+				r = httptest.NewRequest("GET", "/subscribe?timeout=0&category=telemetry", nil)
+				r.Header.Set("Accept", f.contentType)
+				m.subscriptionHandler(rec, r)
+				err = codec.NewDecoderBytes(rec.Body.Bytes(), f.handle).Decode(&fail)
+				if err == nil && fail["error"] != "Invalid timeout arg.  Must be 1-120." {
+					err = fmt.Errorf("%s: unexpected error response %v", f.contentType, fail)
+				}
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
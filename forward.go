@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Metadata key that lists the blocks a forwarded event has passed through
+const forwardedKey = "forwarded_from"
+
+var (
+	// Registered blocks of all running servers
+	blockList  []blockType
+	blockMutex sync.Mutex
+)
+
+// blockType identifies a pubsub block so that events can be forwarded to it
+type blockType struct {
+	// Identifies the Caddy instance that configured the block
+	scope interface{}
+	host  string
+	rule  *ruleType
+}
+
+// name returns the name of the block: its site host followed by its publish
+// path
+func (blk blockType) name() string {
+	return blk.host + blk.rule.publishPath
+}
+
+// blockRegister makes a block available as a forwarding target to other
+// blocks of the same Caddy instance
+func blockRegister(scope interface{}, host string, rule *ruleType) {
+	blockMutex.Lock()
+	blockList = append(blockList, blockType{scope: scope, host: host, rule: rule})
+	blockMutex.Unlock()
+}
+
+// blockUnregister removes a block that is shutting down
+func blockUnregister(rule *ruleType) {
+	blockMutex.Lock()
+	for j := 0; j < len(blockList); j++ {
+		if blockList[j].rule == rule {
+			blockList = append(blockList[:j], blockList[j+1:]...)
+			j--
+		}
+	}
+	blockMutex.Unlock()
+}
+
+// blockFind returns the block of the specified Caddy instance that is
+// identified by target, either a publish path or, to select a particular
+// site, a host followed by a publish path. The block mutex must be held.
+func blockFind(scope interface{}, target string) (blk blockType, err error) {
+	var count int
+	host, path := "", target
+	if pos := strings.Index(target, "/"); pos > 0 {
+		host, path = target[:pos], target[pos:]
+	}
+	for _, item := range blockList {
+		if item.scope == scope && item.rule.publishPath == path && (host == "" || item.host == host) {
+			blk = item
+			count++
+		}
+	}
+	switch count {
+	case 0:
+		err = fmt.Errorf("no pubsub block with publish path \"%s\"", target)
+	case 1:
+	default:
+		err = fmt.Errorf("publish path \"%s\" is ambiguous; qualify it with a host", target)
+	}
+	return
+}
+
+// forwardType copies events in matching categories from one block to
+// another, optionally renaming their categories
+type forwardType struct {
+	poolType
+	pattern string
+	target  string
+	// Renames the categories of copies
+	rename renameType
+	// Identifies the block and Caddy instance that own the rule
+	name  string
+	scope interface{}
+	// Metadata key in which the owning block records authenticated
+	// publishers; empty if it does not
+	publisherMeta string
+}
+
+// forwardParse parses the arguments of a forward subdirective: a category
+// pattern, the publish path of the target block and an optional rename
+// template
+func forwardParse(args []string) (fwd *forwardType, err error) {
+	if len(args) < 2 || len(args) > 3 {
+		err = fmt.Errorf("expecting 2 or 3 arguments after \"forward\", got %d", len(args))
+		return
+	}
+	fwd = &forwardType{pattern: args[0], target: args[1]}
+	if !strings.Contains(fwd.target, "/") {
+		err = fmt.Errorf("forward target must be a publish path, optionally preceded by a host")
+	}
+	if err == nil {
+		template := ""
+		if len(args) == 3 {
+			template = args[2]
+		}
+		fwd.rename, err = renameParse(fwd.pattern, template)
+	}
+	if err != nil {
+		fwd = nil
+	}
+	return
+}
+
+// init prepares the rule to forward events dispatched by the specified
+// manager
+func (fwd *forwardType) init(m *managerType) {
+	fwd.poolType.start(m, 1, fwd.send)
+}
+
+// start satisfies the sourceType interface. It verifies that the target
+// block exists once all blocks have been configured.
+func (fwd *forwardType) start(m *managerType) (err error) {
+	blockMutex.Lock()
+	_, err = blockFind(fwd.scope, fwd.target)
+	blockMutex.Unlock()
+	return
+}
+
+// stop satisfies the sourceType and sinkType interfaces
+func (fwd *forwardType) stop() {
+	fwd.poolType.stop()
+}
+
+// accept satisfies the sinkType interface. If the queue is full, the event is
+// dead-lettered at once.
+func (fwd *forwardType) accept(evt eventType) {
+	if sinkAccepts(fwd.manager, fwd.pattern, evt) && !fwd.enqueue(evt) {
+		go fwd.deadLetter(evt, map[string]string{"forward": fwd.target, "error": "forward queue full"})
+	}
+}
+
+// send publishes a copy of an event in the target block. The copy's metadata
+// lists the blocks it has passed through; an event is never forwarded to a
+// block it has already visited. An event that the target block rejects is
+// dead-lettered.
+func (fwd *forwardType) send(evt eventType) {
+	var blk blockType
+	var err error
+	var trail []string
+
+	if from := evt.Meta[forwardedKey]; from != "" {
+		trail = strings.Split(from, ",")
+	}
+	trail = append(trail, fwd.name)
+	category, _ := fwd.rename.apply(evt.Category)
+	cp := eventNew(category, evt.Data)
+	cp.ContentType, cp.Encoding = evt.ContentType, evt.Encoding
+	cp.Meta = make(map[string]string, len(evt.Meta)+1)
+	for k, v := range evt.Meta {
+		cp.Meta[k] = v
+	}
+	cp.Meta[forwardedKey] = strings.Join(trail, ",")
+	blockMutex.Lock()
+	blk, err = blockFind(fwd.scope, fwd.target)
+	if err == nil && !strings.Contains(","+evt.Meta[forwardedKey]+",", ","+blk.name()+",") {
+		key := blk.rule.publisherMeta
+		if key != "" && key != fwd.publisherMeta {
+			// The value was not stamped by this block, so it is not trusted
+			delete(cp.Meta, key)
+		}
+		err = blk.rule.ingestTrusted(cp)
+	}
+	blockMutex.Unlock()
+	if err != nil {
+		select {
+		case <-fwd.stopped():
+		default:
+			fwd.deadLetter(evt, map[string]string{"forward": fwd.target, "error": err.Error()})
+		}
+	}
+}
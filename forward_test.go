@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardParse(t *testing.T) {
+	var err error
+	var fwd *forwardType
+
+	list := []struct {
+		args     []string
+		category string
+		out      string
+	}{
+		{[]string{"orders.*", "/internal/publish"}, "orders.eu.new", "orders.eu.new"},
+		{[]string{"orders.*.*", "internal.example.com/publish", "shop.{2}.{1}"}, "orders.eu.new", "shop.new.eu"},
+		{[]string{"orders.?", "/internal/publish", "public.{category}"}, "orders.1", "public.orders.1"},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		item := list[j]
+		fwd, err = forwardParse(item.args)
+		if err == nil {
+			if out, _ := fwd.rename.apply(item.category); out != item.out {
+				err = fmt.Errorf("%v: expected %s, got %s", item.args, item.out, out)
+			}
+		}
+	}
+	for _, args := range [][]string{
+		{"orders.*"},
+		{"orders.*", "internal"},
+		{"orders.*", "/internal/publish", "shop.{2}"},
+		{"orders.*", "/internal/publish", "shop.{1}", "extra"},
+	} {
+		if err == nil {
+			_, err = forwardParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var evts []eventType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	forward orders.* /internal/publish internal.{1}
+	forward secret.* /internal/publish
+}
+pubsub /internal/publish /internal/subscribe {
+	forward internal.* /publish
+	max_category_length 16
+}`, "./test")
+	if err == nil {
+		err = hnd.startup()
+	}
+	if err == nil {
+		defer hnd.shutdown()
+		public, internal := hnd.rules[0].manager, hnd.rules[1].manager
+		for _, category := range []string{"orders.new", "news.today", "secret.much-too-long"} {
+			if err == nil {
+				_, err = public.publish(category, "x-"+category)
+			}
+		}
+		if err == nil {
+			evts = listenEvents(internal, "internal.new", 1)
+			if len(evts) != 1 || evts[0].Data != "x-orders.new" || evts[0].Meta[forwardedKey] != "/publish" {
+				err = fmt.Errorf("unexpected forwarded events %+v", evts)
+			}
+		}
+		if err == nil {
+			// The category that exceeds the internal block's limit is
+			// dead-lettered in the public block
+			evts = listenEvents(public, "dead_letter", 1)
+			if len(evts) != 1 || evts[0].Meta["forward"] != "/internal/publish" {
+				err = fmt.Errorf("unexpected dead letters %+v", evts)
+			}
+		}
+		if err == nil {
+			// The forwarded event is not sent back to the block it came from
+			var res eventResponseType
+			rec := httptest.NewRecorder()
+			public.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=internal.new&since_time=0", nil))
+			json.Unmarshal(rec.Body.Bytes(), &res)
+			if len(res.Events) != 0 {
+				err = fmt.Errorf("unexpected returned events %+v", res.Events)
+			}
+		}
+	}
+	if err == nil {
+		hnd, err = handlerGet(`pubsub /publish /subscribe {
+	forward orders.* /missing/publish
+}`, "./test")
+		if err == nil {
+			err = hnd.startup()
+			hnd.shutdown()
+			if err == nil {
+				err = fmt.Errorf("expected error for missing forward target")
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwardPublisher(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var evts []eventType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	publisher_meta
+	forward stamped.* /internal/publish
+}
+pubsub /open/publish /open/subscribe {
+	forward claimed.* /internal/publish
+}
+pubsub /internal/publish /internal/subscribe {
+	publisher_meta
+}`, "./test")
+	if err == nil {
+		err = hnd.startup()
+	}
+	if err == nil {
+		defer hnd.shutdown()
+		stamped, open, internal := hnd.rules[0].manager, hnd.rules[1].manager, hnd.rules[2].manager
+		evt := eventNew("stamped.x", "a")
+		evt.Meta = map[string]string{"publisher": "alice"}
+		_, err = stamped.dispatch(evt)
+		if err == nil {
+			evt = eventNew("claimed.x", "b")
+			evt.Meta = map[string]string{"publisher": "mallory", "trace": "t1"}
+			_, err = open.dispatch(evt)
+		}
+		if err == nil {
+			// The publisher stamped by the source block is kept
+			evts = listenEvents(internal, "stamped.x", 1)
+			if len(evts) != 1 || evts[0].Meta["publisher"] != "alice" {
+				err = fmt.Errorf("unexpected stamped events %+v", evts)
+			}
+		}
+		if err == nil {
+			// A publisher claimed in a block that does not stamp one is removed
+			evts = listenEvents(internal, "claimed.x", 1)
+			if len(evts) != 1 || evts[0].Meta["publisher"] != "" || evts[0].Meta["trace"] != "t1" {
+				err = fmt.Errorf("unexpected claimed events %+v", evts)
+			}
+		}
+		if err == nil {
+			evts = listenEvents(stamped, "dead_letter", 0)
+			if len(evts) != 0 {
+				err = fmt.Errorf("unexpected dead letters %+v", evts)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
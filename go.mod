@@ -3,7 +3,11 @@ module github.com/jung-kurt/caddy-pubsub
 go 1.12
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/caddyserver/caddy v1.0.1
-	github.com/jcuga/golongpoll v1.1.0
-	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/nats-io/nats.go v1.9.2
+	github.com/ugorji/go/codec v1.1.7
+	github.com/xeipuuv/gojsonschema v1.2.0
 )
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Default period for which idempotency keys are remembered
+	idempotencyWindowDefault = 5 * time.Minute
+	// Maximum number of keys remembered at one time; the oldest are
+	// forgotten first
+	idempotencyKeyMax = 10000
+	// Maximum length of an idempotency key
+	idempotencyKeyLenMax = 256
+)
+
+var (
+	errIdempotencyKey      = fmt.Errorf("idempotency key must be at most %d characters long", idempotencyKeyLenMax)
+	errIdempotencyConflict = errors.New("idempotency key was used for a different publication")
+)
+
+// idempotencyEntryType associates an idempotency key with the receipt of the
+// publication that first used it
+type idempotencyEntryType struct {
+	key string
+	// Digest of the publication's category and body
+	digest  [sha256.Size]byte
+	rc      receiptType
+	expires time.Time
+}
+
+// idempotencyDigest returns a digest of the parts of an event that a retried
+// publication must repeat: its category and its body with its content type
+// and encoding
+func idempotencyDigest(evt eventType) [sha256.Size]byte {
+	return sha256.Sum256([]byte(evt.Category + "\x00" + evt.ContentType + "\x00" + evt.Encoding + "\x00" + evt.Data))
+}
+
+// idempotencyType remembers the receipts of recent publications by their
+// idempotency keys so that retried requests are not published twice
+type idempotencyType struct {
+	mutex  sync.Mutex
+	window time.Duration
+	keys   map[string]*list.Element
+	// Entries in order of creation, oldest at front
+	order *list.List
+}
+
+// newIdempotency returns a key store that remembers keys for the specified
+// period, or for the default period if window is zero
+func newIdempotency(window time.Duration) *idempotencyType {
+	if window == 0 {
+		window = idempotencyWindowDefault
+	}
+	return &idempotencyType{
+		window: window,
+		keys:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// forget removes the oldest entry. The mutex must be held.
+func (id *idempotencyType) forget() {
+	el := id.order.Front()
+	delete(id.keys, el.Value.(*idempotencyEntryType).key)
+	id.order.Remove(el)
+}
+
+// do calls fnc and remembers its receipt under the specified key, which is
+// scoped to the specified user so that publishers cannot collide with each
+// other. If the user used the key within the window for a publication with
+// the same digest, fnc is not called and the remembered receipt is returned
+// with dup set to true; if the digest differs, errIdempotencyConflict is
+// returned. An empty key disables this check. Calls are serialized so that
+// concurrent retries cannot both publish.
+func (id *idempotencyType) do(user, key string, digest [sha256.Size]byte,
+	fnc func() (receiptType, error)) (rc receiptType, dup bool, err error) {
+	if key == "" {
+		rc, err = fnc()
+		return
+	}
+	if len(key) > idempotencyKeyLenMax {
+		err = errIdempotencyKey
+		return
+	}
+	key = user + "\x00" + key
+	now := time.Now()
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	for id.order.Len() > 0 && !id.order.Front().Value.(*idempotencyEntryType).expires.After(now) {
+		id.forget()
+	}
+	if el, ok := id.keys[key]; ok {
+		ent := el.Value.(*idempotencyEntryType)
+		if ent.digest == digest {
+			rc = ent.rc
+			dup = true
+		} else {
+			err = errIdempotencyConflict
+		}
+	} else {
+		rc, err = fnc()
+		if err == nil {
+			if id.order.Len() >= idempotencyKeyMax {
+				id.forget()
+			}
+			id.keys[key] = id.order.PushBack(&idempotencyEntryType{key: key, digest: digest, rc: rc,
+				expires: now.Add(id.window)})
+		}
+	}
+	return
+}
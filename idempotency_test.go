@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestIdempotency(t *testing.T) {
+	var err error
+	var rc receiptType
+	var dup bool
+
+	calls := 0
+	fnc := func() (receiptType, error) {
+		calls++
+		return receiptType{id: fmt.Sprintf("id%d", calls)}, nil
+	}
+	digest := idempotencyDigest(eventNew("a", "x"))
+	id := newIdempotency(50 * time.Millisecond)
+	rc, dup, err = id.do("", "k", digest, fnc)
+	if err == nil && (dup || rc.id != "id1") {
+		err = fmt.Errorf("first call: unexpected receipt %+v, duplicate %v", rc, dup)
+	}
+	if err == nil {
+		rc, dup, err = id.do("", "k", digest, fnc)
+		if err == nil && (!dup || rc.id != "id1" || calls != 1) {
+			err = fmt.Errorf("repeated call: unexpected receipt %+v, duplicate %v", rc, dup)
+		}
+	}
+	if err == nil {
+		// Keys are scoped to the user
+		rc, dup, err = id.do("bob", "k", digest, fnc)
+		if err == nil && (dup || rc.id != "id2") {
+			err = fmt.Errorf("other user: unexpected receipt %+v, duplicate %v", rc, dup)
+		}
+	}
+	if err == nil {
+		// A key cannot be reused for a different publication
+		_, _, err = id.do("", "k", idempotencyDigest(eventNew("a", "y")), fnc)
+		if err == errIdempotencyConflict {
+			err = nil
+		} else {
+			err = fmt.Errorf("expected conflict, got %v", err)
+		}
+	}
+	if err == nil {
+		rc, dup, err = id.do("", "", digest, fnc)
+		if err == nil && (dup || calls != 3) {
+			err = fmt.Errorf("empty key: unexpected receipt %+v, duplicate %v", rc, dup)
+		}
+	}
+	if err == nil {
+		time.Sleep(60 * time.Millisecond)
+		rc, dup, err = id.do("", "k", digest, fnc)
+		if err == nil && (dup || rc.id != "id4") {
+			err = fmt.Errorf("expired key: unexpected receipt %+v, duplicate %v", rc, dup)
+		}
+	}
+	if err == nil {
+		_, _, err = id.do("", strings.Repeat("k", idempotencyKeyLenMax+1), digest, fnc)
+		if err == errIdempotencyKey {
+			err = nil
+		} else {
+			err = fmt.Errorf("expected key length error, got %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishDuplicate(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	stats_path /stats
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		var ids []string
+		for j := 0; j < 2; j++ {
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/publish?category=a&body=x&idempotency_key=abc", nil))
+			ids = append(ids, rec.Header().Get("Pubsub-Id"))
+			if (j == 1) != (rec.Header().Get("Pubsub-Duplicate") == "true") {
+				err = fmt.Errorf("attempt %d: unexpected duplicate header", j)
+			}
+		}
+		if err == nil && (ids[0] == "" || ids[0] != ids[1]) {
+			err = fmt.Errorf("expected matching identifiers, got %v", ids)
+		}
+		if err == nil {
+			// Another user's key does not collide, and a key cannot be
+			// reused for a different body
+			for _, item := range []struct {
+				user, url string
+				code      int
+				dup       bool
+			}{
+				{"alice", "/publish?category=a&body=x&idempotency_key=abc", 200, false},
+				{"alice", "/publish?category=a&body=x&idempotency_key=abc", 200, true},
+				{"", "/publish?category=a&body=y&idempotency_key=abc", 409, false},
+			} {
+				if err == nil {
+					rec := httptest.NewRecorder()
+					req := httptest.NewRequest("GET", item.url, nil)
+					req = req.WithContext(context.WithValue(req.Context(), httpserver.RemoteUserCtxKey, item.user))
+					hnd.ServeHTTP(rec, req)
+					if rec.Code != item.code || (rec.Header().Get("Pubsub-Duplicate") == "true") != item.dup {
+						err = fmt.Errorf("%s %s: unexpected response %d %v", item.user, item.url, rec.Code, rec.Header())
+					}
+				}
+			}
+		}
+		if err == nil {
+			st := hnd.rules[0].manager.snapshot()
+			if st.Published != 2 {
+				err = fmt.Errorf("expected 2 publications, got %d", st.Published)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
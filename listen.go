@@ -0,0 +1,414 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Default permissions of a Unix domain socket
+	listenModeDefault = 0660
+	// Maximum length in bytes of a record read from a stream
+	listenRecordMax = 1024 * 1024
+	// Maximum size in bytes of a datagram
+	listenDatagramMax = 65535
+)
+
+var (
+	errRecord = errors.New("records must be of the form category<TAB>body or a JSON object")
+)
+
+// recordType is a record in JSON form
+type recordType struct {
+	Category    string            `json:"category"`
+	Body        string            `json:"body"`
+	ContentType string            `json:"content_type"`
+	Encoding    string            `json:"encoding"`
+	Meta        map[string]string `json:"meta"`
+}
+
+// listenType publishes events received as records on a Unix domain socket
+// or a TCP or UDP address. Access to a Unix domain socket is governed by its
+// file permissions.
+type listenType struct {
+	network string
+	address string
+	mode    os.FileMode
+	// Returns the event described by a record
+	parse func(rec []byte) (eventType, error)
+	// Divides a stream into records
+	split bufio.SplitFunc
+	// If true, each datagram is a single record; otherwise it holds
+	// newline-delimited records
+	whole bool
+	// Validates, transforms and dispatches received events
+	ingest func(evt eventType) error
+	// Identifies the Caddy instance that configured the listener
+	scope interface{}
+	// The shared socket and its listener or connection
+	socket   *socketType
+	listener net.Listener
+	packet   net.PacketConn
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// listenParse parses the arguments of a listen subdirective: a network, one
+// of "unix" or "udp", an address and options of the form key=value
+func listenParse(args []string) (ln *listenType, err error) {
+	if len(args) < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"listen\", got %d", len(args))
+		return
+	}
+	ln = &listenType{network: args[0], address: args[1], mode: listenModeDefault,
+		parse: recordParse, split: bufio.ScanLines}
+	switch ln.network {
+	case "unix", "udp":
+	default:
+		err = fmt.Errorf("expecting \"unix\" or \"udp\" after \"listen\", got \"%s\"", ln.network)
+	}
+	if err == nil {
+		err = optionsParse(args[2:], func(key, val string) (err error) {
+			var mode uint64
+			switch {
+			case key == "mode" && ln.network == "unix":
+				mode, err = strconv.ParseUint(val, 8, 32)
+				if err == nil && mode > 0777 {
+					err = fmt.Errorf("listen mode must be an octal permission such as 0660")
+				}
+				ln.mode = os.FileMode(mode)
+			default:
+				err = fmt.Errorf("unrecognized listen option \"%s\"", key)
+			}
+			return
+		})
+	}
+	if err != nil {
+		ln = nil
+	}
+	return
+}
+
+// recordCheck returns an error if the specified event, received by a
+// listener, cannot be published in the block. A trusted event, copied from
+// another block, may carry the block's publisher metadata key.
+func (rule *ruleType) recordCheck(evt eventType, trusted bool) (err error) {
+	err = evt.encodingCheck()
+	if err == nil {
+		err = rule.eventCheck(evt)
+	}
+	if err == nil && rule.publisherMeta != "" && !trusted {
+		if _, ok := evt.Meta[rule.publisherMeta]; ok {
+			err = errMetaReserve
+		}
+	}
+	return
+}
+
+// recordParse returns the event described by a record. A record that begins
+// with "{" is a JSON object with the fields "category", "body" and,
+// optionally, "content_type", "encoding" and "meta". Any other record is a
+// category followed by a tab and the body.
+func recordParse(line []byte) (evt eventType, err error) {
+	var rec recordType
+	if bytes.HasPrefix(line, []byte("{")) {
+		err = json.Unmarshal(line, &rec)
+		if err == nil && len(rec.Meta) > 0 {
+			meta := make(map[string]string)
+			for key, val := range rec.Meta {
+				if err == nil {
+					err = metaSet(meta, strings.ToLower(key), val)
+				}
+			}
+			rec.Meta = meta
+		}
+	} else if pos := bytes.IndexByte(line, '\t'); pos >= 0 {
+		rec.Category = string(line[:pos])
+		rec.Body = string(line[pos+1:])
+	} else {
+		err = errRecord
+	}
+	if err == nil {
+		evt = eventNew(rec.Category, rec.Body)
+		evt.ContentType, evt.Encoding = rec.ContentType, rec.Encoding
+		if len(rec.Meta) > 0 {
+			evt.Meta = rec.Meta
+		}
+	}
+	return
+}
+
+// publish dispatches the event described by a record. Records that are
+// malformed or violate the block's limits are discarded.
+func (ln *listenType) publish(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > 0 {
+		evt, err := ln.parse(line)
+		if err == nil {
+			ln.ingest(evt)
+		}
+	}
+}
+
+// socketType is a bound socket that is shared by the listeners of
+// successive Caddy instances. On reload, Caddy starts the new instance before
+// it shuts down the old one, so the new listener takes over the socket rather
+// than binding the address again.
+type socketType struct {
+	key      string
+	listener net.Listener
+	packet   net.PacketConn
+	// The socket file of a Unix domain socket as it was created
+	file os.FileInfo
+	// Listeners using the socket, most recently started last; the last one
+	// receives what the socket reads
+	owners []*listenType
+	// Closed when the read loop ends
+	done chan struct{}
+}
+
+var (
+	socketMutex sync.Mutex
+	socketMap   = make(map[string]*socketType)
+)
+
+// socketKey returns the key under which a listener's socket is shared, or
+// an empty string if it is not shared because its port is chosen by the
+// system
+func (ln *listenType) socketKey() string {
+	if ln.network != "unix" && strings.HasSuffix(ln.address, ":0") {
+		return ""
+	}
+	return ln.network + " " + ln.address
+}
+
+// socketBind binds a new socket for the listener. A stale socket file left
+// by an earlier server is replaced.
+func (ln *listenType) socketBind() (sock *socketType, err error) {
+	sock = &socketType{key: ln.socketKey(), done: make(chan struct{})}
+	switch ln.network {
+	case "unix":
+		if info, statErr := os.Stat(ln.address); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(ln.address)
+		}
+		sock.listener, err = net.Listen("unix", ln.address)
+		if err == nil {
+			// The file is removed only if it is still this socket's
+			sock.listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			sock.file, err = os.Stat(ln.address)
+			if err != nil {
+				sock.listener.Close()
+			}
+		}
+	case "tcp":
+		sock.listener, err = net.Listen("tcp", ln.address)
+	case "udp":
+		sock.packet, err = net.ListenPacket("udp", ln.address)
+	}
+	if err == nil {
+		if sock.packet != nil {
+			go sock.receive()
+		} else {
+			go sock.accept()
+		}
+	} else {
+		sock = nil
+	}
+	return
+}
+
+// owner returns the listener that receives what the socket reads, or nil if
+// the socket is closing
+func (sock *socketType) owner() (ln *listenType) {
+	socketMutex.Lock()
+	if len(sock.owners) > 0 {
+		ln = sock.owners[len(sock.owners)-1]
+	}
+	socketMutex.Unlock()
+	return
+}
+
+// close closes the socket, removing its file if it has not been replaced,
+// and waits for its read loop to end
+func (sock *socketType) close() {
+	if sock.packet != nil {
+		sock.packet.Close()
+	} else {
+		sock.listener.Close()
+		if sock.file != nil {
+			if info, err := os.Stat(sock.listener.Addr().String()); err == nil && os.SameFile(info, sock.file) {
+				os.Remove(sock.listener.Addr().String())
+			}
+		}
+	}
+	<-sock.done
+}
+
+// accept hands stream connections to the socket's owner until the socket is
+// closed
+func (sock *socketType) accept() {
+	defer close(sock.done)
+	for {
+		conn, err := sock.listener.Accept()
+		if err != nil {
+			return
+		}
+		if ln := sock.owner(); ln != nil {
+			ln.serveStart(conn)
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+// receive hands datagrams to the socket's owner until the socket is closed
+func (sock *socketType) receive() {
+	defer close(sock.done)
+	buf := make([]byte, listenDatagramMax)
+	for {
+		count, _, err := sock.packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ln := sock.owner(); ln != nil {
+			ln.datagram(buf[:count])
+		}
+	}
+}
+
+// start satisfies the sourceType interface. If a listener of an earlier
+// Caddy instance has the same address, its socket is taken over; a listener
+// of the same instance with the same address is an error.
+func (ln *listenType) start(m *managerType) (err error) {
+	ln.conns = make(map[net.Conn]bool)
+	key := ln.socketKey()
+	socketMutex.Lock()
+	sock := socketMap[key]
+	if sock != nil {
+		for _, owner := range sock.owners {
+			if owner.scope == ln.scope {
+				err = fmt.Errorf("listen %s %s: address is used by another listener", ln.network, ln.address)
+			}
+		}
+	} else {
+		sock, err = ln.socketBind()
+		if err == nil && key != "" {
+			socketMap[key] = sock
+		}
+	}
+	if err == nil {
+		sock.owners = append(sock.owners, ln)
+		ln.socket = sock
+		ln.listener, ln.packet = sock.listener, sock.packet
+	}
+	socketMutex.Unlock()
+	if err == nil && ln.network == "unix" {
+		err = os.Chmod(ln.address, ln.mode)
+		if err != nil {
+			ln.stop()
+		}
+	}
+	return
+}
+
+// stop satisfies the sourceType interface. Open connections are closed. The
+// socket is closed, and its file removed, unless a listener of a newer Caddy
+// instance has taken it over.
+func (ln *listenType) stop() {
+	var last bool
+	sock := ln.socket
+	if sock == nil {
+		return
+	}
+	socketMutex.Lock()
+	for j, owner := range sock.owners {
+		if owner == ln {
+			sock.owners = append(sock.owners[:j], sock.owners[j+1:]...)
+			break
+		}
+	}
+	if len(sock.owners) == 0 {
+		last = true
+		if socketMap[sock.key] == sock {
+			delete(socketMap, sock.key)
+		}
+	}
+	socketMutex.Unlock()
+	if last {
+		sock.close()
+	}
+	ln.mutex.Lock()
+	ln.closed = true
+	for conn := range ln.conns {
+		conn.Close()
+	}
+	ln.mutex.Unlock()
+	ln.wg.Wait()
+	ln.socket = nil
+}
+
+// serveStart serves a stream connection unless the listener is stopped
+func (ln *listenType) serveStart(conn net.Conn) {
+	ln.mutex.Lock()
+	if ln.closed {
+		conn.Close()
+	} else {
+		ln.conns[conn] = true
+		ln.wg.Add(1)
+		go ln.serve(conn)
+	}
+	ln.mutex.Unlock()
+}
+
+// serve publishes each record read from the specified connection. The
+// connection is closed if a record exceeds the maximum length.
+func (ln *listenType) serve(conn net.Conn) {
+	defer ln.wg.Done()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), listenRecordMax)
+	scanner.Split(ln.split)
+	for scanner.Scan() {
+		ln.publish(scanner.Bytes())
+	}
+	conn.Close()
+	ln.mutex.Lock()
+	delete(ln.conns, conn)
+	ln.mutex.Unlock()
+}
+
+// datagram publishes the records of a datagram
+func (ln *listenType) datagram(buf []byte) {
+	if ln.whole {
+		ln.publish(buf)
+	} else {
+		for _, line := range bytes.Split(buf, []byte("\n")) {
+			ln.publish(line)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenParse(t *testing.T) {
+	var err error
+	var ln *listenType
+
+	ln, err = listenParse([]string{"unix", "/run/pubsub.sock", "mode=0600"})
+	if err == nil && (ln.network != "unix" || ln.address != "/run/pubsub.sock" || ln.mode != 0600) {
+		err = fmt.Errorf("unexpected listener %+v", ln)
+	}
+	for _, args := range [][]string{
+		{"unix"},
+		{"tcp", "127.0.0.1:9000"},
+		{"unix", "/run/pubsub.sock", "mode=rw"},
+		{"unix", "/run/pubsub.sock", "mode=1777"},
+		{"udp", "127.0.0.1:9000", "mode=0600"},
+	} {
+		if err == nil {
+			_, err = listenParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordParse(t *testing.T) {
+	var err error
+	var evt eventType
+
+	list := []struct {
+		rec, category, body, meta string
+	}{
+		{"cron\tbackup done", "cron", "backup done", ""},
+		{"cron\ta\tb", "cron", "a\tb", ""},
+		{`{"category":"cron","body":"line 1\nline 2","meta":{"Host":"db1"}}`, "cron", "line 1\nline 2", "db1"},
+		{"no tab", "", "", ""},
+		{`{"category":`, "", "", ""},
+		{`{"category":"cron","body":"x","meta":{"bad key":"v"}}`, "", "", ""},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		item := list[j]
+		evt, err = recordParse([]byte(item.rec))
+		if item.category == "" {
+			if err == nil {
+				err = fmt.Errorf("%q: expected error", item.rec)
+			} else {
+				err = nil
+			}
+		} else if err == nil && (evt.Category != item.category || evt.Data != item.body || evt.Meta["host"] != item.meta) {
+			err = fmt.Errorf("%q: unexpected event %+v", item.rec, evt)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenEvents waits for the specified number of events in a category
+func listenEvents(m *managerType, category string, count int) (evts []eventType) {
+	var res eventResponseType
+	for j := 0; j < 100 && len(res.Events) < count; j++ {
+		time.Sleep(10 * time.Millisecond)
+		rec := httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category="+category+"&since_time=0", nil))
+		json.Unmarshal(rec.Body.Bytes(), &res)
+	}
+	return res.Events
+}
+
+func TestListen(t *testing.T) {
+	var err error
+	var dir string
+	var info os.FileInfo
+	var conn net.Conn
+	var evts []eventType
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	rule := ruleType{maxBodySize: 16, manager: m}
+	path := filepath.Join(dir, "pubsub.sock")
+	for _, args := range [][]string{{"unix", path, "mode=0600"}, {"udp", "127.0.0.1:0"}} {
+		var ln *listenType
+		if err == nil {
+			ln, err = listenParse(args)
+		}
+		if err == nil {
+			ln.ingest = rule.ingest
+			err = ln.start(m)
+		}
+		if err == nil {
+			defer ln.stop()
+			address := path
+			if ln.network == "udp" {
+				address = ln.packet.LocalAddr().String()
+			}
+			conn, err = net.Dial(ln.network, address)
+		}
+		if err == nil {
+			_, err = conn.Write([]byte(args[0] + "\tfirst\n\tno category\n" + args[0] + "\tbody that is much too long\n" +
+				`{"category":"` + args[0] + `","body":"second","meta":{"host":"db1"}}` + "\n"))
+			conn.Close()
+		}
+		if err == nil {
+			evts = listenEvents(m, args[0], 2)
+			if len(evts) != 2 || evts[0].Data != "first" || evts[1].Data != "second" || evts[1].Meta["host"] != "db1" {
+				err = fmt.Errorf("%s: unexpected events %+v", args[0], evts)
+			}
+		}
+	}
+	if err == nil {
+		info, err = os.Stat(path)
+		if err == nil && info.Mode().Perm() != 0600 {
+			err = fmt.Errorf("unexpected socket permissions %v", info.Mode())
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenReload(t *testing.T) {
+	var err error
+	var dir string
+	var pc net.PacketConn
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Find a free UDP port
+	pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := pc.LocalAddr().String()
+	pc.Close()
+	path := filepath.Join(dir, "pubsub.sock")
+	for _, args := range [][]string{{"unix", path}, {"udp", udpAddr}} {
+		var oldLn, newLn, dupLn *listenType
+		var got chan string
+		oldScope, newScope := new(int), new(int)
+		if err == nil {
+			oldLn, err = listenParse(args)
+		}
+		if err == nil {
+			newLn, err = listenParse(args)
+		}
+		if err == nil {
+			dupLn, err = listenParse(args)
+		}
+		if err == nil {
+			got = make(chan string, 4)
+			oldLn.scope, oldLn.ingest = oldScope, func(evt eventType) error { got <- "old " + evt.Data; return nil }
+			newLn.scope, newLn.ingest = newScope, func(evt eventType) error { got <- "new " + evt.Data; return nil }
+			dupLn.scope = newScope
+			err = oldLn.start(nil)
+		}
+		// As on a reload, the new instance starts before the old one stops
+		if err == nil {
+			err = newLn.start(nil)
+		}
+		if err == nil {
+			if dupLn.start(nil) == nil {
+				dupLn.stop()
+				err = fmt.Errorf("%s: expected error for listener of the same instance", args[0])
+			}
+			oldLn.stop()
+		}
+		if err == nil {
+			var conn net.Conn
+			conn, err = net.Dial(args[0], args[1])
+			if err == nil {
+				_, err = conn.Write([]byte("x\tafter reload\n"))
+				conn.Close()
+			}
+		}
+		if err == nil {
+			select {
+			case str := <-got:
+				if str != "new after reload" {
+					err = fmt.Errorf("%s: unexpected record %q", args[0], str)
+				}
+			case <-time.After(time.Second):
+				err = fmt.Errorf("%s: no record received after reload", args[0])
+			}
+		}
+		if newLn != nil && newLn.socket != nil {
+			newLn.stop()
+		}
+		if err == nil && args[0] == "unix" {
+			if _, statErr := os.Stat(path); !os.IsNotExist(statErr) {
+				err = fmt.Errorf("expected socket file to be removed")
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
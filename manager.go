@@ -0,0 +1,951 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+// The event manager in this file is modeled on github.com/jcuga/golongpoll
+// (MIT license) and produces the same JSON responses, so existing longpoll
+// clients such as ps.js work unchanged. Unlike golongpoll, it accounts for
+// the size of every retained event so that buffers can be bounded by bytes as
+// well as by count.
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Categories longer than this are rejected, as they are by golongpoll
+	categoryLenMax = 1024
+	// Interval at which expired events are purged from quiet categories
+	purgeInterval = 5 * time.Second
+)
+
+var (
+	errCategoryLen = fmt.Errorf("category must be 1-%d characters long", categoryLenMax)
+	errShutdown    = errors.New("event manager has been shut down")
+)
+
+// retentionType tracks the events retained by all managers in the process so
+// that the process-wide byte limit can evict the oldest of them regardless of
+// the block that holds it. Its mutex may be acquired while a manager mutex is
+// held but never the reverse.
+type retentionType struct {
+	mutex sync.Mutex
+	// Every retained event of every manager, oldest at front
+	entries *list.List
+	bytes   int64
+	// Running managers, used to determine the limit
+	managers map[*managerType]bool
+	// Smallest nonzero maxTotalBytes of the running managers; zero if none
+	// imposes a limit
+	limit int64
+	// Bytes held outside the managers' buffers, such as scheduled events
+	reserved int64
+}
+
+// retention is the process-wide record of retained events
+var retention = retentionType{
+	entries:  list.New(),
+	managers: make(map[*managerType]bool),
+}
+
+// register includes the specified manager's maxTotalBytes in the
+// process-wide limit
+func (r *retentionType) register(m *managerType) {
+	r.mutex.Lock()
+	r.managers[m] = true
+	r.reckon()
+	r.mutex.Unlock()
+}
+
+// unregister excludes the specified manager from the process-wide limit and
+// discards the events other managers evicted from it
+func (r *retentionType) unregister(m *managerType) {
+	r.mutex.Lock()
+	delete(r.managers, m)
+	m.doomed = nil
+	r.reckon()
+	r.mutex.Unlock()
+}
+
+// reckon sets the process-wide limit to the smallest one configured by a
+// running manager. The retention mutex must be held.
+func (r *retentionType) reckon() {
+	r.limit = 0
+	for m := range r.managers {
+		if lim := m.opt.maxTotalBytes; lim > 0 && (r.limit == 0 || lim < r.limit) {
+			r.limit = lim
+		}
+	}
+}
+
+// ceiling returns the current process-wide limit
+func (r *retentionType) ceiling() (limit int64) {
+	r.mutex.Lock()
+	limit = r.limit
+	r.mutex.Unlock()
+	return
+}
+
+// total returns the number of event bytes retained by all managers
+func (r *retentionType) total() (bytes int64) {
+	r.mutex.Lock()
+	bytes = r.bytes
+	r.mutex.Unlock()
+	return
+}
+
+// release stops counting the specified event toward the process-wide limit
+func (r *retentionType) release(ent *entryType) {
+	r.mutex.Lock()
+	r.unlink(ent)
+	r.mutex.Unlock()
+}
+
+// unlink removes the specified event from the process-wide list if it is
+// still there. The retention mutex must be held.
+func (r *retentionType) unlink(ent *entryType) {
+	if ent.totElem != nil {
+		r.entries.Remove(ent.totElem)
+		ent.totElem = nil
+		r.bytes -= ent.size
+	}
+}
+
+// shrink evicts the oldest events of any manager until the specified number
+// of additional bytes fits within the process-wide limit. Evicted events that
+// belong to the specified manager are returned for it to remove; those of
+// other managers are handed to their owners. The retention mutex must be
+// held.
+func (r *retentionType) shrink(m *managerType, size int64) (own []*entryType) {
+	for r.limit > 0 && r.bytes+r.reserved+size > r.limit && r.entries.Len() > 0 {
+		old := r.entries.Front().Value.(*entryType)
+		r.unlink(old)
+		if old.manager == m {
+			own = append(own, old)
+		} else {
+			old.manager.doomed = append(old.manager.doomed, old)
+		}
+	}
+	return
+}
+
+// admit evicts the oldest events of any manager until the specified event
+// fits within the process-wide limit and then counts it. Evicted events that
+// belong to the event's own manager are returned for it to remove. If the
+// event cannot fit, ok is false. The manager mutex of the event's owner must
+// be held.
+func (r *retentionType) admit(ent *entryType) (own []*entryType, ok bool) {
+	r.mutex.Lock()
+	own = r.shrink(ent.manager, ent.size)
+	ok = r.limit == 0 || r.bytes+r.reserved+ent.size <= r.limit
+	if ok {
+		ent.totElem = r.entries.PushBack(ent)
+		r.bytes += ent.size
+	}
+	r.mutex.Unlock()
+	return
+}
+
+// reserve counts bytes held outside the buffers of the specified manager
+// toward the process-wide limit, evicting retained events to make room.
+// Evicted events that belong to the manager are returned for it to remove.
+// If the held bytes alone would exceed the limit, ok is false. The manager
+// mutex must be held.
+func (r *retentionType) reserve(m *managerType, size int64) (own []*entryType, ok bool) {
+	r.mutex.Lock()
+	ok = r.limit == 0 || r.reserved+size <= r.limit
+	if ok {
+		r.reserved += size
+		own = r.shrink(m, 0)
+	}
+	r.mutex.Unlock()
+	return
+}
+
+// unreserve releases bytes counted by reserve
+func (r *retentionType) unreserve(size int64) {
+	r.mutex.Lock()
+	r.reserved -= size
+	r.mutex.Unlock()
+}
+
+// optionsType holds the buffering options of a pubsub block. The first four
+// fields correspond to the golongpoll options of the same name. A zero byte
+// limit means that no limit is imposed.
+type optionsType struct {
+	MaxLongpollTimeoutSeconds      int
+	MaxEventBufferSize             int
+	EventTimeToLiveSeconds         int
+	DeleteEventAfterFirstRetrieval bool
+	// Maximum number of bytes retained for a single category
+	maxCategoryBytes int64
+	// Maximum number of bytes retained by the pubsub block
+	maxBlockBytes int64
+	// Maximum number of bytes retained by all pubsub blocks in the process
+	maxTotalBytes int64
+	// Period after which an unacknowledged event is redelivered; zero if
+	// acknowledgements are disabled
+	ackTimeout time.Duration
+	// Number of deliveries after which an unacknowledged event is moved to
+	// the dead-letter category
+	maxDeliveries int
+	// Category that receives events whose deliveries are exhausted
+	deadLetter string
+}
+
+// eventType is a published event. Its JSON encoding matches golongpoll's
+// with the addition of the event's unique identifier.
+type eventType struct {
+	// Milliseconds since the Unix epoch; zero until the event is dispatched
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Category  string `json:"category"`
+	Data      string `json:"data"`
+	ID        string `json:"id"`
+	// Media type of the body, if supplied by the publisher
+	ContentType string `json:"content_type,omitempty"`
+	// "base64" if Data holds the base64 encoding of a binary body
+	Encoding string `json:"encoding,omitempty"`
+	// Key/value pairs supplied by the publisher
+	Meta map[string]string `json:"meta,omitempty"`
+	// Identifiers of the only clients that receive the event, or empty if
+	// every subscriber receives it. The list is not revealed to subscribers.
+	To []string `json:"-"`
+}
+
+// size returns the number of bytes an event is charged against the buffer
+// limits: the length of its category, body, content type, metadata and
+// recipients
+func (evt eventType) size() (size int64) {
+	size = int64(len(evt.Category) + len(evt.Data) + len(evt.ContentType))
+	for key, val := range evt.Meta {
+		size += int64(len(key) + len(val))
+	}
+	for _, id := range evt.To {
+		size += int64(len(id))
+	}
+	return
+}
+
+// entryType is an event retained in a manager's buffers. It is linked into
+// its category's list, the manager's list of all retained events and the
+// process-wide list so that the oldest event can be found quickly at each
+// scope.
+type entryType struct {
+	evt              eventType
+	size             int64
+	cat              *categoryType
+	catElem, allElem *list.Element
+	// Link in the process-wide list; nil once the event's bytes no longer
+	// count toward the process-wide limit
+	totElem *list.Element
+	manager *managerType
+	// Deliveries to consumer groups and acknowledging clients, by consumer
+	deliveries map[string]*deliveryType
+}
+
+// categoryType holds the retained events and waiting subscribers of a single
+// category
+type categoryType struct {
+	name string
+	// Retained events, oldest at front
+	events *list.List
+	bytes  int64
+	// Subscribers blocked in a longpoll for this category
+	waiters map[*waiterType]bool
+}
+
+// waiterType is a subscriber blocked in a longpoll
+type waiterType struct {
+	// Buffered with a capacity of one; at most one batch is ever sent
+	ch chan []eventType
+	// Only matching events are sent
+	sel selectorType
+}
+
+// selectorType determines which events a subscriber receives
+type selectorType struct {
+	// Identifies the subscriber as a recipient of direct messages
+	clientID string
+	filter   filterType
+	// Consumer group that shares the category's events, or empty if the
+	// subscriber receives every event
+	group string
+	// True if the subscriber acknowledges the events it receives
+	ack bool
+}
+
+// match returns true if the specified event is addressed to the subscriber,
+// or to no one in particular, and satisfies the subscriber's filter
+func (sel selectorType) match(evt eventType) (ok bool) {
+	ok = len(evt.To) == 0
+	for j := 0; j < len(evt.To) && !ok; j++ {
+		ok = evt.To[j] == sel.clientID
+	}
+	return ok && sel.filter.match(evt)
+}
+
+// statsType reports the activity of a manager. The counters are cumulative;
+// the remaining fields describe the current state.
+type statsType struct {
+	// Events accepted for publication
+	Published int64 `json:"published"`
+	// Events removed, or never retained, because a count or byte limit was
+	// reached
+	Evicted      int64 `json:"evicted"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+	// Events removed because their time to live elapsed
+	Expired int64 `json:"expired"`
+	// Repeated deliveries of unacknowledged events
+	Redelivered int64 `json:"redelivered"`
+	// Events moved to the dead-letter category
+	DeadLettered int64 `json:"dead_lettered"`
+	// Events rejected because their bodies do not conform to a schema
+	Invalid int64 `json:"invalid"`
+	// Events and bytes currently retained by this block
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+	// Categories with retained events or waiting subscribers
+	Categories int `json:"categories"`
+	// Subscribers currently blocked in a longpoll
+	Subscribers int `json:"subscribers"`
+	// Bytes currently retained by all pubsub blocks in the process
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// managerType dispatches published events to subscribers and retains them, up
+// to the configured limits, for subscribers that connect later
+type managerType struct {
+	opt        optionsType
+	mutex      sync.Mutex
+	categories map[string]*categoryType
+	// Every retained event in order of publication, oldest at front
+	all   *list.List
+	stats statsType
+	quit  chan struct{}
+	// Tracks subscribed clients if presence is enabled, otherwise nil
+	presence *presenceType
+	// Reply categories of requests awaiting replies
+	replies map[string]bool
+	// Receive every dispatched event
+	sinks []sinkType
+	// Events evicted by other managers to honor the process-wide limit that
+	// have not yet been removed from this manager's buffers. Guarded by the
+	// retention mutex.
+	doomed []*entryType
+	// Bytes held for the block outside its buffers, such as scheduled events
+	reserved int64
+}
+
+type eventResponseType struct {
+	Events []eventType `json:"events"`
+}
+
+type timeoutResponseType struct {
+	TimeoutMessage string `json:"timeout"`
+	Timestamp      int64  `json:"timestamp"`
+}
+
+// msec returns the number of milliseconds since the Unix epoch
+func msec(tm time.Time) int64 {
+	return tm.UnixNano() / int64(time.Millisecond)
+}
+
+// idNew returns a random identifier of 16 hexadecimal characters
+func idNew() string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// eventNew returns an undispatched event with a new identifier
+func eventNew(category, data string) eventType {
+	return eventType{Category: category, Data: data, ID: idNew()}
+}
+
+// newManager validates the specified options, substituting golongpoll's
+// defaults for missing values, and starts a new event manager
+func newManager(opt optionsType) (m *managerType, err error) {
+	if opt.MaxLongpollTimeoutSeconds == 0 {
+		opt.MaxLongpollTimeoutSeconds = 120
+	}
+	if opt.MaxEventBufferSize == 0 {
+		opt.MaxEventBufferSize = 250
+	}
+	if opt.ackTimeout > 0 && opt.maxDeliveries == 0 {
+		opt.maxDeliveries = maxDeliveriesDefault
+	}
+	if opt.deadLetter == "" {
+		opt.deadLetter = deadLetterDefault
+	}
+	switch {
+	case opt.MaxLongpollTimeoutSeconds < 1:
+		err = errors.New("MaxLongpollTimeoutSeconds must be at least 1")
+	case opt.MaxEventBufferSize < 1:
+		err = errors.New("MaxEventBufferSize must be at least 1")
+	case opt.EventTimeToLiveSeconds < 0:
+		err = errors.New("EventTimeToLiveSeconds must not be negative")
+	case opt.maxCategoryBytes < 0 || opt.maxBlockBytes < 0 || opt.maxTotalBytes < 0:
+		err = errors.New("byte limits must not be negative")
+	}
+	if err == nil {
+		m = &managerType{
+			opt:        opt,
+			categories: make(map[string]*categoryType),
+			all:        list.New(),
+			quit:       make(chan struct{}),
+		}
+		if opt.ackTimeout > 0 {
+			// The redelivery sweep also expires events
+			go m.redeliver()
+		} else if opt.EventTimeToLiveSeconds > 0 {
+			go m.purge()
+		}
+	}
+	return
+}
+
+// purge periodically removes expired events until the manager is shut down.
+// Expired events are also removed whenever a category is accessed; this
+// catches categories that have gone quiet.
+func (m *managerType) purge() {
+	tick := time.NewTicker(purgeInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			m.lock()
+			m.expire()
+			m.mutex.Unlock()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// shutdown stops the manager and its sinks and releases its retained events.
+// Subscribers that are blocked in a longpoll are released when their timeout
+// elapses.
+func (m *managerType) shutdown() {
+	m.lock()
+	select {
+	case <-m.quit:
+	default:
+		close(m.quit)
+		retention.unregister(m)
+		for _, snk := range m.sinks {
+			snk.stop()
+		}
+		for m.all.Len() > 0 {
+			m.remove(m.all.Front().Value.(*entryType))
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// lock acquires the manager mutex and removes any events that other managers
+// have evicted from it in the meantime
+func (m *managerType) lock() {
+	m.mutex.Lock()
+	retention.mutex.Lock()
+	doomed := m.doomed
+	m.doomed = nil
+	retention.mutex.Unlock()
+	for _, ent := range doomed {
+		// The event may have been removed since it was evicted
+		if ent.catElem != nil {
+			m.evict(ent)
+		}
+	}
+}
+
+// category returns the named category, creating it if necessary. The manager
+// mutex must be held.
+func (m *managerType) category(name string) (cat *categoryType) {
+	cat = m.categories[name]
+	if cat == nil {
+		cat = &categoryType{
+			name:    name,
+			events:  list.New(),
+			waiters: make(map[*waiterType]bool),
+		}
+		m.categories[name] = cat
+	}
+	return
+}
+
+// tidy deletes the specified category if it no longer holds events or
+// waiting subscribers. The manager mutex must be held.
+func (m *managerType) tidy(cat *categoryType) {
+	if cat.events.Len() == 0 && len(cat.waiters) == 0 && m.categories[cat.name] == cat {
+		delete(m.categories, cat.name)
+	}
+}
+
+// remove unlinks a retained event and releases its bytes. The manager mutex
+// must be held.
+func (m *managerType) remove(ent *entryType) {
+	ent.cat.events.Remove(ent.catElem)
+	ent.cat.bytes -= ent.size
+	m.all.Remove(ent.allElem)
+	ent.catElem = nil
+	m.stats.Bytes -= ent.size
+	retention.release(ent)
+	m.tidy(ent.cat)
+}
+
+// evict removes the specified retained event because a limit has been
+// reached. The manager mutex must be held.
+func (m *managerType) evict(ent *entryType) {
+	m.stats.Evicted++
+	m.stats.EvictedBytes += ent.size
+	m.remove(ent)
+}
+
+// expire removes events whose time to live has elapsed. Since events are
+// held in order of publication, only the oldest need to be examined. The
+// manager mutex must be held.
+func (m *managerType) expire() {
+	if m.opt.EventTimeToLiveSeconds > 0 {
+		limit := msec(time.Now()) - int64(m.opt.EventTimeToLiveSeconds)*1000
+		for m.all.Len() > 0 {
+			ent := m.all.Front().Value.(*entryType)
+			if ent.evt.Timestamp > limit {
+				break
+			}
+			m.stats.Expired++
+			m.remove(ent)
+		}
+	}
+}
+
+// catFits returns true if an event of the specified size can be added to the
+// specified category without exceeding the category's own limits. The manager
+// mutex must be held.
+func (m *managerType) catFits(cat *categoryType, size int64) bool {
+	return cat.events.Len() < m.opt.MaxEventBufferSize &&
+		(m.opt.maxCategoryBytes == 0 || cat.bytes+size <= m.opt.maxCategoryBytes)
+}
+
+// fits returns true if an event of the specified size can be retained in the
+// specified category without exceeding the limits of the category and the
+// block. The manager mutex must be held.
+func (m *managerType) fits(cat *categoryType, size int64) bool {
+	return m.catFits(cat, size) &&
+		(m.opt.maxBlockBytes == 0 || m.stats.Bytes+m.reserved+size <= m.opt.maxBlockBytes)
+}
+
+// reserve counts bytes held outside the manager's buffers, such as scheduled
+// events, toward the block and process limits, evicting retained events to
+// make room. ok is false if the held bytes alone would exceed a limit.
+func (m *managerType) reserve(size int64) (ok bool) {
+	var own []*entryType
+
+	m.lock()
+	ok = m.opt.maxBlockBytes == 0 || m.reserved+size <= m.opt.maxBlockBytes
+	if ok {
+		own, ok = retention.reserve(m, size)
+	}
+	if ok {
+		m.reserved += size
+		for _, ent := range own {
+			m.evict(ent)
+		}
+		for m.opt.maxBlockBytes > 0 && m.stats.Bytes+m.reserved > m.opt.maxBlockBytes && m.all.Len() > 0 {
+			m.evict(m.all.Front().Value.(*entryType))
+		}
+	}
+	m.mutex.Unlock()
+	return
+}
+
+// unreserve releases bytes counted by reserve
+func (m *managerType) unreserve(size int64) {
+	m.lock()
+	m.reserved -= size
+	retention.unreserve(size)
+	m.mutex.Unlock()
+}
+
+// retain stores the specified event, evicting older events as needed to
+// honor the configured limits. Events are evicted from the event's own
+// category while its limits are exceeded and otherwise from anywhere in the
+// block, oldest first. The process-wide limit then evicts the oldest events
+// of any block. An event that cannot fit even after eviction is not retained,
+// in which case nil is returned. The manager mutex must be held.
+func (m *managerType) retain(cat *categoryType, evt eventType) (ent *entryType) {
+	var own []*entryType
+
+	size := evt.size()
+	limit := retention.ceiling()
+	ok := (m.opt.maxCategoryBytes == 0 || size <= m.opt.maxCategoryBytes) &&
+		(m.opt.maxBlockBytes == 0 || size <= m.opt.maxBlockBytes) &&
+		(limit == 0 || size <= limit)
+	for ok && !m.fits(cat, size) && m.all.Len() > 0 {
+		if m.catFits(cat, size) {
+			ent = m.all.Front().Value.(*entryType)
+		} else {
+			ent = cat.events.Front().Value.(*entryType)
+		}
+		m.evict(ent)
+	}
+	ent = nil
+	if ok && m.fits(cat, size) {
+		ent = &entryType{evt: evt, size: size, cat: cat, manager: m}
+		own, ok = retention.admit(ent)
+		for _, old := range own {
+			m.evict(old)
+		}
+	} else {
+		ok = false
+	}
+	if ok {
+		// Evicting events of this block may have deleted the category
+		cat = m.category(cat.name)
+		ent.cat = cat
+		ent.catElem = cat.events.PushBack(ent)
+		ent.allElem = m.all.PushBack(ent)
+		cat.bytes += size
+		m.stats.Bytes += size
+	} else {
+		// The event is too large for a limit by itself, or the limit was
+		// lowered by a block that started after it was checked
+		ent = nil
+		m.stats.Evicted++
+		m.stats.EvictedBytes += size
+	}
+	return
+}
+
+// publish dispatches a new event with the specified category and data. The
+// dispatched event is returned.
+func (m *managerType) publish(category, data string) (eventType, error) {
+	return m.dispatch(eventNew(category, data))
+}
+
+// dispatch timestamps the specified event, sends it to the subscribers
+// currently waiting for its category, and retains it for subscribers that
+// connect later. The dispatched event is returned.
+func (m *managerType) dispatch(evt eventType) (out eventType, err error) {
+	if len(evt.Category) == 0 || len(evt.Category) > categoryLenMax {
+		err = errCategoryLen
+	} else {
+		m.lock()
+		select {
+		case <-m.quit:
+			err = errShutdown
+		default:
+			m.expire()
+			evt = m.deliver(evt)
+		}
+		m.mutex.Unlock()
+	}
+	out = evt
+	return
+}
+
+// invalid counts an event that was rejected by schema validation
+func (m *managerType) invalid() {
+	m.lock()
+	m.stats.Invalid++
+	m.mutex.Unlock()
+}
+
+// deliver does the work of dispatch. The manager mutex must be held.
+func (m *managerType) deliver(evt eventType) eventType {
+	var tracked []selectorType
+	now := time.Now()
+	evt.Timestamp = msec(now)
+	m.stats.Published++
+	cat := m.category(evt.Category)
+	waiting := false
+	keep := false
+	for w := range cat.waiters {
+		if w.sel.match(evt) && !consumed(tracked, w.sel) {
+			w.ch <- []eventType{evt}
+			delete(cat.waiters, w)
+			waiting = true
+			if w.sel.tracked() {
+				tracked = append(tracked, w.sel)
+				// An event must be retained until it is acknowledged
+				keep = keep || w.sel.ack
+			}
+		}
+	}
+	if keep || !(waiting && m.opt.DeleteEventAfterFirstRetrieval) {
+		if ent := m.retain(cat, evt); ent != nil {
+			for _, sel := range tracked {
+				m.record(ent, sel, now)
+			}
+		}
+	}
+	m.tidy(cat)
+	for _, snk := range m.sinks {
+		snk.accept(evt)
+	}
+	return evt
+}
+
+// consumed returns true if the specified subscriber is tracked and a
+// subscriber of the same consumer appears in the list. Only one member of a
+// consumer group receives each event.
+func consumed(list []selectorType, sel selectorType) (ok bool) {
+	if sel.tracked() {
+		key := sel.consumer()
+		for j := 0; j < len(list) && !ok; j++ {
+			ok = list[j].consumer() == key
+		}
+	}
+	return
+}
+
+// since returns, oldest first, the retained events in the specified category
+// that were published after the specified time and that match the specified
+// selector. For a tracked subscriber, the time is ignored and the retained
+// events pending delivery to its consumer are returned instead; a member of a
+// consumer group receives at most one. Deliveries to tracked subscribers are
+// recorded. If the manager is configured to delete events after their first
+// retrieval, events returned to untracked subscribers are removed. The
+// manager mutex must be held.
+func (m *managerType) since(cat *categoryType, tm int64, sel selectorType) (evts []eventType) {
+	var dead []eventType
+	now := time.Now()
+	key := sel.consumer()
+	if sel.tracked() {
+		tm = 0
+	}
+	el := cat.events.Back()
+	for el != nil && el.Value.(*entryType).evt.Timestamp > tm {
+		el = el.Prev()
+	}
+	if el == nil {
+		el = cat.events.Front()
+	} else {
+		el = el.Next()
+	}
+	for el != nil {
+		ent := el.Value.(*entryType)
+		el = el.Next()
+		if sel.match(ent.evt) {
+			if sel.tracked() {
+				ok, exhausted := m.pending(ent, key, now)
+				if exhausted {
+					dead = append(dead, m.deadLetter(ent, key))
+				} else if ok {
+					evts = append(evts, ent.evt)
+					m.record(ent, sel, now)
+					if sel.group != "" {
+						// Deliver one event at a time to spread work across
+						// the group
+						el = nil
+					}
+				}
+			} else {
+				evts = append(evts, ent.evt)
+				if m.opt.DeleteEventAfterFirstRetrieval {
+					m.remove(ent)
+				}
+			}
+		}
+	}
+	for _, evt := range dead {
+		m.deliver(evt)
+	}
+	return
+}
+
+// snapshot returns the current statistics of the manager
+func (m *managerType) snapshot() (st statsType) {
+	m.lock()
+	m.expire()
+	st = m.stats
+	st.Events = int64(m.all.Len())
+	st.Categories = len(m.categories)
+	for _, cat := range m.categories {
+		st.Subscribers += len(cat.waiters)
+	}
+	m.mutex.Unlock()
+	st.TotalBytes = retention.total()
+	return
+}
+
+// writeJSON writes the JSON encoding of val to w
+func writeJSON(w io.Writer, val interface{}) {
+	buf, err := json.Marshal(val)
+	if err == nil {
+		w.Write(buf)
+	} else {
+		io.WriteString(w, `{"error": "json marshaller failed"}`)
+	}
+}
+
+// wait returns the events in the specified category that were published
+// after the specified time and that match the specified selector. If there
+// are none, it blocks until one is published, the timeout elapses or the
+// context is canceled, in which case no events are returned.
+func (m *managerType) wait(ctx context.Context, category string, sinceTime int64, sel selectorType,
+	timeout time.Duration) (evts []eventType, err error) {
+	var waiter *waiterType
+
+	m.lock()
+	select {
+	case <-m.quit:
+		err = errShutdown
+	default:
+		m.expire()
+		cat := m.category(category)
+		evts = m.since(cat, sinceTime, sel)
+		if len(evts) == 0 {
+			// The category may have been emptied and deleted by since
+			cat = m.category(category)
+			waiter = &waiterType{ch: make(chan []eventType, 1), sel: sel}
+			cat.waiters[waiter] = true
+		}
+		m.tidy(cat)
+	}
+	m.mutex.Unlock()
+
+	if waiter != nil {
+		tmr := time.NewTimer(timeout)
+		select {
+		case evts = <-waiter.ch:
+		case <-tmr.C:
+		case <-ctx.Done():
+		}
+		tmr.Stop()
+		if evts == nil {
+			m.lock()
+			if cat := m.categories[category]; cat != nil {
+				delete(cat.waiters, waiter)
+				m.tidy(cat)
+			}
+			m.mutex.Unlock()
+			// An event may have been dispatched after the timer fired but
+			// before the waiter was removed
+			select {
+			case evts = <-waiter.ch:
+			default:
+			}
+		}
+	}
+	return
+}
+
+// subscriptionHandler responds to a longpoll request. The query parameters
+// "timeout", "category" and "since_time" are interpreted as they are by
+// golongpoll. The optional parameter "filter" restricts the response to
+// matching events; see filterParse. The optional parameter "client_id"
+// identifies the subscriber as a recipient of direct messages; if it is
+// missing, a random identifier is assigned. Either way, the identifier is
+// reported in the Pubsub-Client-Id response header. If presence is enabled, a
+// supplied identifier and the optional parameter "client_info" also describe
+// the subscriber to other clients. The optional parameter "group" makes the
+// subscriber a member of a consumer group whose members share the category's
+// events, each event going to only one member. If acknowledgements are
+// enabled, the parameter "ack" with the value "true" requests redelivery of
+// events that the subscriber's consumer does not acknowledge in time. The
+// call blocks until a matching event is published or the timeout elapses.
+// The response is encoded in the format preferred by the request's Accept
+// header; see formatNegotiate.
+func (m *managerType) subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var sinceTime int64
+	var evts []eventType
+
+	format := formatNegotiate(r)
+	hdr := w.Header()
+	format.headerSet(hdr)
+	hdr.Add("Vary", "Accept")
+	hdr.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	hdr.Set("Pragma", "no-cache")
+	hdr.Set("Expires", "0")
+	query := r.URL.Query()
+	timeout, err := strconv.Atoi(query.Get("timeout"))
+	if err != nil || timeout < 1 || timeout > m.opt.MaxLongpollTimeoutSeconds {
+		format.errorWrite(w, fmt.Sprintf("Invalid timeout arg.  Must be 1-%d.", m.opt.MaxLongpollTimeoutSeconds))
+		return
+	}
+	category := query.Get("category")
+	if len(category) == 0 || len(category) > categoryLenMax {
+		format.errorWrite(w, fmt.Sprintf("Invalid subscription category, must be 1-%d characters long.", categoryLenMax))
+		return
+	}
+	sinceTime = msec(time.Now())
+	if str := query.Get("since_time"); str != "" {
+		sinceTime, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			format.errorWrite(w, "Invalid last_event_time arg.")
+			return
+		}
+	}
+
+	clientID := query.Get("client_id")
+	clientInfo := query.Get("client_info")
+	if len(clientID) > clientIDLenMax || len(clientInfo) > clientInfoLenMax {
+		format.errorWrite(w, fmt.Sprintf("Invalid client, client_id must be at most %d and client_info at most %d characters long.",
+			clientIDLenMax, clientInfoLenMax))
+		return
+	}
+	group := query.Get("group")
+	if len(group) > clientIDLenMax {
+		format.errorWrite(w, fmt.Sprintf("Invalid group, must be at most %d characters long.", clientIDLenMax))
+		return
+	}
+	filter, err := filterParse(query.Get("filter"))
+	if err != nil {
+		format.errorWrite(w, "Invalid filter: "+err.Error())
+		return
+	}
+
+	ack := query.Get("ack") == "true" || query.Get("ack") == "1"
+	if ack && (m.opt.ackTimeout == 0 || (clientID == "" && group == "")) {
+		format.errorWrite(w, "Invalid ack arg, acknowledgements must be enabled and client_id or group specified.")
+		return
+	}
+	if m.presence != nil && clientID != "" {
+		m.presence.enter(category, clientID, clientInfo)
+		defer m.presence.exit(category, clientID)
+	}
+	if clientID == "" {
+		clientID = idNew()
+	}
+	hdr.Set("Pubsub-Client-Id", clientID)
+	sel := selectorType{clientID: clientID, filter: filter, group: group, ack: ack}
+
+	evts, err = m.wait(r.Context(), category, sinceTime, sel, time.Duration(timeout)*time.Second)
+	if err == errShutdown {
+		format.errorWrite(w, "Event manager has been shut down.")
+		return
+	}
+	if evts != nil {
+		format.write(w, eventResponseType{Events: evts})
+	} else if r.Context().Err() == nil {
+		format.write(w, timeoutResponseType{
+			TimeoutMessage: "no events before timeout",
+			Timestamp:      msec(time.Now()),
+		})
+	}
+}
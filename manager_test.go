@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// managerGet returns a new manager for the specified options. Any error
+// encountered is reported as a fatal test error.
+func managerGet(t *testing.T, opt optionsType) (m *managerType) {
+	var err error
+	m, err = newManager(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRetain(t *testing.T) {
+	var err error
+	var st statsType
+
+	// Each event is 10 bytes: a 1-byte category and a 9-byte body
+	body := strings.Repeat("x", 9)
+	m := managerGet(t, optionsType{maxCategoryBytes: 30, maxBlockBytes: 50})
+	defer m.shutdown()
+	for j := 0; j < 4 && err == nil; j++ {
+		_, err = m.publish("a", body)
+	}
+	for j := 0; j < 3 && err == nil; j++ {
+		_, err = m.publish("b", body)
+	}
+	if err == nil {
+		// Category a is capped at 3 events, then the block limit of 50 bytes
+		// evicts the oldest event of a when the third b event arrives
+		st = m.snapshot()
+		if st.Published != 7 || st.Events != 5 || st.Bytes != 50 || st.Evicted != 2 || st.EvictedBytes != 20 {
+			err = fmt.Errorf("unexpected statistics %+v", st)
+		}
+	}
+	if err == nil {
+		// An event larger than the category limit is never retained
+		_, err = m.publish("c", strings.Repeat("y", 40))
+		if err == nil {
+			st = m.snapshot()
+			if st.Events != 5 || st.Evicted != 3 {
+				err = fmt.Errorf("oversized event: unexpected statistics %+v", st)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetainTotal(t *testing.T) {
+	var err error
+	var st1, st2 statsType
+
+	body := strings.Repeat("x", 9)
+	m1 := managerGet(t, optionsType{})
+	m2 := managerGet(t, optionsType{maxTotalBytes: 40})
+	retention.register(m1)
+	retention.register(m2)
+	for j := 0; j < 3 && err == nil; j++ {
+		_, err = m1.publish("a", body)
+	}
+	for j := 0; j < 3 && err == nil; j++ {
+		_, err = m2.publish("a", body)
+	}
+	if err == nil {
+		// The limit set by m2 applies to m1 as well. Room for m2's events is
+		// made by evicting the oldest events in the process, which are m1's
+		// and any left over from earlier tests.
+		st1, st2 = m1.snapshot(), m2.snapshot()
+		if st1.Events != 1 || st1.Evicted != 2 || st1.Bytes != 10 {
+			err = fmt.Errorf("unexpected statistics %+v", st1)
+		} else if st2.Events != 3 || st2.Evicted != 0 || st2.TotalBytes != 40 {
+			err = fmt.Errorf("unexpected statistics %+v", st2)
+		}
+	}
+	if err == nil {
+		// m1's next event evicts its own remaining event, and the one after
+		// that evicts m2's oldest
+		for j := 0; j < 2 && err == nil; j++ {
+			_, err = m1.publish("a", body)
+		}
+		if err == nil {
+			st1, st2 = m1.snapshot(), m2.snapshot()
+			if st1.Events != 2 || st1.Evicted != 3 || st2.Events != 2 || st2.Evicted != 1 {
+				err = fmt.Errorf("unexpected statistics %+v, %+v", st1, st2)
+			}
+		}
+	}
+	m2.shutdown()
+	if err == nil && retention.ceiling() != 0 {
+		err = fmt.Errorf("expected no limit after shutdown, got %d", retention.ceiling())
+	}
+	m1.shutdown()
+	if err == nil && retention.total() != 0 {
+		err = fmt.Errorf("expected no total bytes after shutdown, got %d", retention.total())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubscriptionHandler(t *testing.T) {
+	var err error
+	var res eventResponseType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	_, err = m.publish("demo", "one")
+	if err == nil {
+		_, err = m.publish("demo", "two")
+	}
+	if err == nil {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/subscribe?timeout=1&category=demo&since_time=0", nil)
+		m.subscriptionHandler(rec, req)
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil && (len(res.Events) != 2 || res.Events[0].Data != "one" || res.Events[1].Data != "two") {
+			err = fmt.Errorf("unexpected response %s", rec.Body.String())
+		}
+	}
+	if err == nil {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/subscribe?timeout=0&category=demo", nil)
+		m.subscriptionHandler(rec, req)
+		if !strings.Contains(rec.Body.String(), "Invalid timeout") {
+			err = fmt.Errorf("expected timeout error, got %s", rec.Body.String())
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var err error
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	get := func(query string) (evts []eventType, err error) {
+		rec := httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=jobs&"+query, nil))
+		var res eventResponseType
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		evts = res.Events
+		return
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		if err == nil {
+			_, err = m.publish("jobs", body)
+		}
+	}
+	// Members of a group receive retained events one at a time, each only
+	// once, while other groups and plain subscribers are unaffected
+	var got string
+	for j := 0; j < 3 && err == nil; j++ {
+		var evts []eventType
+		evts, err = get("group=workers")
+		if err == nil {
+			if len(evts) == 1 {
+				got += evts[0].Data
+			} else {
+				err = fmt.Errorf("expected 1 event, got %d", len(evts))
+			}
+		}
+	}
+	if err == nil && got != "abc" {
+		err = fmt.Errorf("expected abc, got %s", got)
+	}
+	if err == nil {
+		var evts []eventType
+		evts, err = get("group=auditors")
+		if err == nil && (len(evts) != 1 || evts[0].Data != "a") {
+			err = fmt.Errorf("second group: unexpected events %+v", evts)
+		}
+		if err == nil {
+			evts, err = get("since_time=0")
+			if err == nil && len(evts) != 3 {
+				err = fmt.Errorf("plain subscriber: expected 3 events, got %d", len(evts))
+			}
+		}
+	}
+	if err == nil {
+		// Of two waiting members, only one receives a new event
+		done := make(chan int, 2)
+		for j := 0; j < 2; j++ {
+			go func() {
+				evts, _ := get("group=workers")
+				done <- len(evts)
+			}()
+		}
+		for m.snapshot().Subscribers < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		_, err = m.publish("jobs", "d")
+		if err == nil {
+			if total := <-done + <-done; total != 1 {
+				err = fmt.Errorf("expected 1 delivery, got %d", total)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	// Prefix of form fields that carry metadata
+	metaFieldPrefix = "meta."
+	// Prefix of request headers that carry metadata
+	metaHeaderPrefix = "Pubsub-Meta-"
+	// Maximum number of metadata entries per event
+	metaCountMax = 32
+	// Maximum length of a metadata value
+	metaValueLenMax = 1024
+)
+
+var (
+	metaKeyRe      = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+	errMetaKey     = errors.New("metadata keys must be 1 to 64 lowercase letters, digits, '_', '.' or '-'")
+	errMetaCount   = fmt.Errorf("at most %d metadata entries are allowed", metaCountMax)
+	errMetaValue   = fmt.Errorf("metadata values must be at most %d characters long", metaValueLenMax)
+	errMetaReserve = errors.New("metadata key is reserved for the publisher identity")
+)
+
+// metaSet validates and stores a single metadata entry
+func metaSet(meta map[string]string, key, val string) (err error) {
+	switch {
+	case !metaKeyRe.MatchString(key):
+		err = errMetaKey
+	case len(val) > metaValueLenMax:
+		err = errMetaValue
+	default:
+		meta[key] = val
+		if len(meta) > metaCountMax {
+			err = errMetaCount
+		}
+	}
+	return
+}
+
+// metaGet collects the metadata of a publication request. Metadata is taken
+// from request headers of the form "Pubsub-Meta-Key: value" and from form
+// fields of the form "meta.key=value", with form fields taking precedence.
+// Keys are case-insensitive and are reported in lowercase. If the block
+// stamps publisher identities, the authenticated user name is stored under
+// the configured key; a publisher cannot supply that key itself. The form
+// must already be parsed. A nil map is returned if the request carries no
+// metadata.
+func (rule *ruleType) metaGet(r *http.Request) (meta map[string]string, err error) {
+	meta = make(map[string]string)
+	for name, vals := range r.Header {
+		if err == nil && strings.HasPrefix(name, metaHeaderPrefix) && len(vals) > 0 {
+			err = metaSet(meta, strings.ToLower(name[len(metaHeaderPrefix):]), vals[0])
+		}
+	}
+	for name, vals := range r.Form {
+		if err == nil && strings.HasPrefix(name, metaFieldPrefix) && len(vals) > 0 {
+			err = metaSet(meta, strings.ToLower(name[len(metaFieldPrefix):]), vals[0])
+		}
+	}
+	if err == nil && rule.publisherMeta != "" {
+		if _, ok := meta[rule.publisherMeta]; ok {
+			err = errMetaReserve
+		} else if user, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string); user != "" {
+			err = metaSet(meta, rule.publisherMeta, user)
+		}
+	}
+	if err != nil || len(meta) == 0 {
+		meta = nil
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestMetaGet(t *testing.T) {
+	var err error
+	var meta map[string]string
+
+	rule := ruleType{publisherMeta: "publisher"}
+	req := httptest.NewRequest("GET", "/publish?category=a&body=x&meta.Priority=high&meta.trace=2", nil)
+	req.Header.Set("Pubsub-Meta-Trace", "1")
+	req.Header.Set("Pubsub-Meta-Content-Type", "text/plain")
+	req = req.WithContext(context.WithValue(req.Context(), httpserver.RemoteUserCtxKey, "alice"))
+	err = req.ParseForm()
+	if err == nil {
+		meta, err = rule.metaGet(req)
+	}
+	if err == nil && (len(meta) != 4 || meta["priority"] != "high" || meta["trace"] != "2" ||
+		meta["content-type"] != "text/plain" || meta["publisher"] != "alice") {
+		err = fmt.Errorf("unexpected metadata %v", meta)
+	}
+	if err == nil {
+		list := []struct {
+			url string
+			err error
+		}{
+			{"/publish?meta.publisher=mallory", errMetaReserve},
+			{"/publish?meta.bad%20key=1", errMetaKey},
+			{"/publish?meta.k=" + strings.Repeat("v", metaValueLenMax+1), errMetaValue},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			req = httptest.NewRequest("GET", list[j].url, nil)
+			err = req.ParseForm()
+			if err == nil {
+				_, err = rule.metaGet(req)
+				if err == list[j].err {
+					err = nil
+				} else {
+					err = fmt.Errorf("%s: expected %v, got %v", list[j].url, list[j].err, err)
+				}
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaDispatch(t *testing.T) {
+	var err error
+	var res eventResponseType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	evt := eventNew("demo", "body")
+	evt.Meta = map[string]string{"priority": "high"}
+	_, err = m.dispatch(evt)
+	if err == nil {
+		rec := httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=demo&since_time=0", nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil && (len(res.Events) != 1 || res.Events[0].Meta["priority"] != "high") {
+			err = fmt.Errorf("unexpected response %s", rec.Body.String())
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// Time allowed for each connection attempt and publication
+	mqttTimeout = 10 * time.Second
+	// Delay between initial connection attempts
+	mqttRetry = 5 * time.Second
+	// Delay before a refused subscription is requested again
+	mqttResubscribe = time.Second
+	// Metadata key that records the topic of an event received from a broker
+	mqttTopicKey = "mqtt_topic"
+)
+
+// mqttType bridges a block and an MQTT broker. Messages published to the
+// broker on topics that match the inbound filters are published as events,
+// and events in categories that match the outbound filters are published to
+// the broker. A topic and its category differ only in their separators: "/"
+// in topics, "." in categories.
+type mqttType struct {
+	poolType
+	broker   string
+	clientID string
+	username string
+	password string
+	qos      byte
+	in       []string
+	out      []string
+	client   mqtt.Client
+	// Validates, transforms and dispatches received events
+	ingest func(evt eventType) error
+	// Closed when the connection loop ends
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// topicFilterValid returns true if the specified MQTT topic filter is well
+// formed: "+" must occupy an entire level and "#" the entire last level
+func topicFilterValid(filter string) bool {
+	levels := strings.Split(filter, "/")
+	for j, level := range levels {
+		switch {
+		case level == "+":
+		case level == "#":
+			if j != len(levels)-1 {
+				return false
+			}
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return filter != ""
+}
+
+// topicMatch returns true if the specified topic matches the specified MQTT
+// topic filter. In the filter, "+" matches a single level and "#" matches
+// any number of trailing levels, including none.
+func topicMatch(filter, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for j, level := range fl {
+		switch {
+		case level == "#":
+			return true
+		case j >= len(tl):
+			return false
+		case level != "+" && level != tl[j]:
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// mqttParse parses the arguments of an mqtt subdirective: the URL of a
+// broker, such as tcp://127.0.0.1:1883, and options of the form key=value
+func mqttParse(args []string) (br *mqttType, err error) {
+	if len(args) < 1 {
+		err = fmt.Errorf("expecting at least 1 argument after \"mqtt\", got %d", len(args))
+		return
+	}
+	br = &mqttType{broker: args[0], clientID: "caddy-pubsub-" + idNew()}
+	err = optionsParse(args[1:], func(key, val string) (err error) {
+		switch key {
+		case "client_id":
+			br.clientID = val
+		case "username":
+			br.username = val
+		case "password":
+			br.password = val
+		case "qos":
+			var qos int
+			qos, err = strconv.Atoi(val)
+			if err != nil || qos < 0 || qos > 2 {
+				err = fmt.Errorf("mqtt qos must be 0, 1 or 2")
+			}
+			br.qos = byte(qos)
+		case "in", "out":
+			if !topicFilterValid(val) {
+				err = fmt.Errorf("invalid mqtt topic filter \"%s\"", val)
+			} else if key == "in" {
+				br.in = append(br.in, val)
+			} else {
+				br.out = append(br.out, val)
+			}
+		default:
+			err = fmt.Errorf("unrecognized mqtt option \"%s\"", key)
+		}
+		return
+	})
+	if err == nil && len(br.in) == 0 && len(br.out) == 0 {
+		err = fmt.Errorf("expecting at least one \"in\" or \"out\" topic filter after \"mqtt\"")
+	}
+	if err != nil {
+		br = nil
+	}
+	return
+}
+
+// init prepares the bridge to forward events dispatched by the specified
+// manager. No connection is made until the bridge is started.
+func (br *mqttType) init(m *managerType) {
+	opts := mqtt.NewClientOptions().AddBroker(br.broker).SetClientID(br.clientID).
+		SetUsername(br.username).SetPassword(br.password).SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).SetOnConnectHandler(br.subscribe)
+	br.client = mqtt.NewClient(opts)
+	br.poolType.start(m, 1, br.send)
+}
+
+// subscribe subscribes to the inbound filters. It is called each time the
+// client connects to the broker. A subscription that the broker refuses or
+// does not acknowledge is requested again after a delay for as long as the
+// connection stays open.
+func (br *mqttType) subscribe(client mqtt.Client) {
+	for _, filter := range br.in {
+		for !br.subscribeFilter(client, filter) {
+			select {
+			case <-br.stopped():
+				return
+			case <-time.After(mqttResubscribe):
+			}
+			if !client.IsConnectionOpen() {
+				// The next connection subscribes again
+				return
+			}
+		}
+	}
+}
+
+// subscribeFilter requests a subscription to the specified filter and
+// returns true if the broker grants it
+func (br *mqttType) subscribeFilter(client mqtt.Client, filter string) (ok bool) {
+	tok := client.Subscribe(filter, br.qos, br.receive)
+	if tok.WaitTimeout(mqttTimeout) && tok.Error() == nil {
+		if sub, isSub := tok.(*mqtt.SubscribeToken); isSub {
+			// A granted QoS of 0x80 reports failure
+			qos, found := sub.Result()[filter]
+			ok = found && qos != 0x80
+		}
+	}
+	return
+}
+
+// receive publishes a message received from the broker as an event. The
+// message topic is recorded in the event's metadata, and a payload that is
+// not valid UTF-8 is stored as base64. Messages that violate the block's
+// limits are discarded.
+func (br *mqttType) receive(client mqtt.Client, msg mqtt.Message) {
+	evt := eventNew(strings.Replace(msg.Topic(), "/", ".", -1), "")
+	evt.bodySet(msg.Payload(), "")
+	evt.Meta = map[string]string{mqttTopicKey: msg.Topic()}
+	br.ingest(evt)
+}
+
+// start satisfies the sourceType interface. The connection is made in the
+// background, retrying until it succeeds, so that an unavailable broker does
+// not prevent the server from starting. Once connected, the client
+// reconnects automatically.
+func (br *mqttType) start(m *managerType) (err error) {
+	br.done = make(chan struct{})
+	go func() {
+		defer close(br.done)
+		for {
+			tok := br.client.Connect()
+			if tok.WaitTimeout(mqttTimeout) && tok.Error() == nil {
+				return
+			}
+			select {
+			case <-br.stopped():
+				return
+			case <-time.After(mqttRetry):
+			}
+		}
+	}()
+	return
+}
+
+// stop satisfies the sourceType and sinkType interfaces. It disconnects from
+// the broker and can safely be called more than once.
+func (br *mqttType) stop() {
+	br.stopOnce.Do(func() {
+		br.poolType.stop()
+		if br.done != nil {
+			<-br.done
+		}
+		br.client.Disconnect(250)
+	})
+}
+
+// accept satisfies the sinkType interface. Events that were received from a
+// broker are not sent back. If the queue is full, the event is dead-lettered
+// at once.
+func (br *mqttType) accept(evt eventType) {
+	if len(br.out) > 0 && sinkAccepts(br.manager, "*", evt) && evt.Meta[mqttTopicKey] == "" &&
+		br.outbound(br.topic(evt.Category)) && !br.enqueue(evt) {
+		go br.deadLetter(evt, map[string]string{"mqtt": br.broker, "error": "mqtt queue full"})
+	}
+}
+
+// topic returns the MQTT topic that corresponds to a category
+func (br *mqttType) topic(category string) string {
+	return strings.Replace(category, ".", "/", -1)
+}
+
+// outbound returns true if the specified topic matches an outbound filter
+func (br *mqttType) outbound(topic string) bool {
+	for _, filter := range br.out {
+		if topicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// send publishes an event to the broker with its raw body, dead-lettering it
+// if the client is not connected or the publication fails
+func (br *mqttType) send(evt eventType) {
+	var err error
+	tok := br.client.Publish(br.topic(evt.Category), br.qos, false, evt.payload())
+	if !tok.WaitTimeout(mqttTimeout) {
+		err = fmt.Errorf("mqtt publication timed out")
+	} else {
+		err = tok.Error()
+	}
+	if err != nil {
+		select {
+		case <-br.stopped():
+		default:
+			br.deadLetter(evt, map[string]string{"mqtt": br.broker, "error": err.Error()})
+		}
+	}
+}
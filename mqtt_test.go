@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// brokerType is a minimal MQTT 3.1.1 broker for testing. Messages are
+// forwarded to matching subscribers at QoS 0.
+type brokerType struct {
+	ln    net.Listener
+	mutex sync.Mutex
+	subs  map[net.Conn][]string
+	// Number of times each filter is yet to be refused
+	refuse map[string]int
+	// Topic and payload of each message published by a client
+	received []string
+}
+
+// brokerConnType is a client connection to the test broker
+type brokerConnType struct {
+	conn  net.Conn
+	mutex sync.Mutex
+}
+
+// brokerNew starts a test broker on a local port
+func brokerNew() (b *brokerType, err error) {
+	b = &brokerType{subs: make(map[net.Conn][]string), refuse: make(map[string]int)}
+	b.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		go func() {
+			for {
+				conn, err := b.ln.Accept()
+				if err != nil {
+					return
+				}
+				go b.serve(&brokerConnType{conn: conn})
+			}
+		}()
+	}
+	return
+}
+
+// url returns the address of the broker as a URL
+func (b *brokerType) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+// write sends a packet to the client
+func (bc *brokerConnType) write(typ byte, body []byte) {
+	var buf []byte
+	buf = append(buf, typ)
+	size := len(body)
+	for {
+		digit := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			digit |= 0x80
+		}
+		buf = append(buf, digit)
+		if size == 0 {
+			break
+		}
+	}
+	bc.mutex.Lock()
+	bc.conn.Write(append(buf, body...))
+	bc.mutex.Unlock()
+}
+
+// brokerString returns a length-prefixed string and the remaining bytes
+func brokerString(buf []byte) (str string, rest []byte) {
+	if len(buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(buf))
+		if len(buf) >= 2+size {
+			str, rest = string(buf[2:2+size]), buf[2+size:]
+		}
+	}
+	return
+}
+
+// publish forwards a message to the subscribers of its topic
+func (b *brokerType) publish(topic, payload string) {
+	body := append([]byte{byte(len(topic) >> 8), byte(len(topic))}, topic...)
+	body = append(body, payload...)
+	b.mutex.Lock()
+	var list []net.Conn
+	for conn, filters := range b.subs {
+		for _, filter := range filters {
+			if topicMatch(filter, topic) {
+				list = append(list, conn)
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+	for _, conn := range list {
+		(&brokerConnType{conn: conn}).write(0x30, body)
+	}
+}
+
+// serve handles the packets of a client connection
+func (b *brokerType) serve(bc *brokerConnType) {
+	rd := bufio.NewReader(bc.conn)
+	defer func() {
+		b.mutex.Lock()
+		delete(b.subs, bc.conn)
+		b.mutex.Unlock()
+		bc.conn.Close()
+	}()
+	for {
+		typ, err := rd.ReadByte()
+		size, shift := 0, uint(0)
+		for err == nil {
+			var digit byte
+			digit, err = rd.ReadByte()
+			size |= int(digit&0x7f) << shift
+			shift += 7
+			if digit&0x80 == 0 {
+				break
+			}
+		}
+		body := make([]byte, size)
+		if err == nil {
+			_, err = io.ReadFull(rd, body)
+		}
+		if err != nil {
+			return
+		}
+		switch typ >> 4 {
+		case 1: // CONNECT
+			bc.write(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			qos := (typ >> 1) & 3
+			topic, rest := brokerString(body)
+			if qos > 0 && len(rest) >= 2 {
+				if qos == 1 {
+					bc.write(0x40, rest[:2])
+				} else {
+					bc.write(0x50, rest[:2])
+				}
+				rest = rest[2:]
+			}
+			b.mutex.Lock()
+			b.received = append(b.received, topic+"|"+string(rest))
+			b.mutex.Unlock()
+			b.publish(topic, string(rest))
+		case 6: // PUBREL
+			bc.write(0x70, body)
+		case 8: // SUBSCRIBE
+			var filter string
+			granted := []byte{}
+			rest := body[2:]
+			for len(rest) > 2 {
+				filter, rest = brokerString(rest)
+				rest = rest[1:]
+				b.mutex.Lock()
+				if b.refuse[filter] > 0 {
+					b.refuse[filter]--
+					granted = append(granted, 0x80)
+				} else {
+					b.subs[bc.conn] = append(b.subs[bc.conn], filter)
+					granted = append(granted, 0)
+				}
+				b.mutex.Unlock()
+			}
+			bc.write(0x90, append(body[:2:2], granted...))
+		case 12: // PINGREQ
+			bc.write(0xd0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// subscribed returns the number of subscriptions held by clients
+func (b *brokerType) subscribed() (count int) {
+	b.mutex.Lock()
+	for _, filters := range b.subs {
+		count += len(filters)
+	}
+	b.mutex.Unlock()
+	return
+}
+
+// receivedGet returns the messages published by clients
+func (b *brokerType) receivedGet() (list []string) {
+	b.mutex.Lock()
+	list = append(list, b.received...)
+	b.mutex.Unlock()
+	return
+}
+
+func TestTopicMatch(t *testing.T) {
+	var err error
+
+	list := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sensors/+/temp", "sensors/kitchen/temp", true},
+		{"sensors/+/temp", "sensors/kitchen/humidity", false},
+		{"sensors/+/temp", "sensors/temp", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/a/b/c", true},
+		{"#", "alerts/fire", true},
+		{"alerts", "alerts/fire", false},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		item := list[j]
+		if topicMatch(item.filter, item.topic) != item.match {
+			err = fmt.Errorf("%s, %s: expected %v", item.filter, item.topic, item.match)
+		}
+	}
+	for _, filter := range []string{"", "a/#/b", "a/b+", "a#"} {
+		if err == nil && topicFilterValid(filter) {
+			err = fmt.Errorf("%q: expected invalid filter", filter)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMqtt(t *testing.T) {
+	var err error
+	var b *brokerType
+	var br *mqttType
+	var evts []eventType
+
+	b, err = brokerNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.ln.Close()
+	// The first subscription is refused and must be requested again
+	b.refuse["sensors/+/temp"] = 1
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	rule := ruleType{manager: m}
+	br, err = mqttParse([]string{b.url(), "qos=1", "in=sensors/+/temp", "out=alerts/#", "out=sensors/#"})
+	if err == nil {
+		br.ingest = rule.ingest
+		br.init(m)
+		m.sinks = append(m.sinks, br)
+		err = br.start(m)
+	}
+	if err == nil {
+		defer br.stop()
+		for j := 0; j < 200 && b.subscribed() == 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// A device publishes readings
+		b.publish("sensors/kitchen/temp", "21.5")
+		b.publish("sensors/kitchen/humidity", "40")
+		evts = listenEvents(m, "sensors.kitchen.temp", 1)
+		if len(evts) != 1 || evts[0].Data != "21.5" || evts[0].Meta[mqttTopicKey] != "sensors/kitchen/temp" {
+			err = fmt.Errorf("unexpected inbound events %+v", evts)
+		}
+	}
+	if err == nil {
+		for _, category := range []string{"alerts.fire", "orders.new", "sensors.kitchen.cmd"} {
+			if err == nil {
+				_, err = m.publish(category, "x-"+category)
+			}
+		}
+	}
+	if err == nil {
+		var list []string
+		for j := 0; j < 100 && len(list) < 2; j++ {
+			time.Sleep(10 * time.Millisecond)
+			list = b.receivedGet()
+		}
+		// The inbound reading is not sent back to the broker
+		time.Sleep(50 * time.Millisecond)
+		list = b.receivedGet()
+		str := strings.Join(list, ",")
+		if str != "alerts/fire|x-alerts.fire,sensors/kitchen/cmd|x-sensors.kitchen.cmd" {
+			err = fmt.Errorf("unexpected outbound messages %s", str)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
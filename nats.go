@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	// Time allowed for each connection attempt
+	natsTimeout = 10 * time.Second
+	// Delay between initial connection attempts
+	natsRetry = 5 * time.Second
+	// Metadata key that records the subject of an event received from NATS
+	natsSubjectKey = "nats_subject"
+)
+
+var (
+	errNatsConnect = errors.New("not connected to NATS server")
+)
+
+// natsType bridges a block and a NATS server. Messages on subjects that match
+// the inbound patterns are published as events in categories of the same
+// name, and events in categories that match the outbound patterns are
+// published on subjects of the same name.
+type natsType struct {
+	poolType
+	url   string
+	queue string
+	in    []string
+	out   []string
+	// Validates, transforms and dispatches received events
+	ingest func(evt eventType) error
+	mutex  sync.Mutex
+	conn   *nats.Conn
+	// Closed when the connection loop ends
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// subjectPatternValid returns true if the specified NATS subject pattern is
+// well formed: tokens are not empty, "*" occupies an entire token and ">"
+// the entire last token
+func subjectPatternValid(pattern string) bool {
+	tokens := strings.Split(pattern, ".")
+	for j, tok := range tokens {
+		switch {
+		case tok == "*":
+		case tok == ">":
+			if j != len(tokens)-1 {
+				return false
+			}
+		case tok == "", strings.ContainsAny(tok, "*> \t"):
+			return false
+		}
+	}
+	return true
+}
+
+// subjectMatch returns true if the specified subject matches the specified
+// NATS subject pattern. In the pattern, "*" matches a single token and ">"
+// matches one or more trailing tokens.
+func subjectMatch(pattern, subject string) bool {
+	pl := strings.Split(pattern, ".")
+	sl := strings.Split(subject, ".")
+	for j, tok := range pl {
+		switch {
+		case j >= len(sl):
+			return false
+		case tok == ">":
+			return true
+		case tok != "*" && tok != sl[j]:
+			return false
+		}
+	}
+	return len(pl) == len(sl)
+}
+
+// natsParse parses the arguments of a nats subdirective: the URL of a
+// server, such as nats://127.0.0.1:4222, and options of the form key=value
+func natsParse(args []string) (br *natsType, err error) {
+	if len(args) < 1 {
+		err = fmt.Errorf("expecting at least 1 argument after \"nats\", got %d", len(args))
+		return
+	}
+	br = &natsType{url: args[0]}
+	err = optionsParse(args[1:], func(key, val string) (err error) {
+		switch key {
+		case "queue":
+			br.queue = val
+		case "in", "out":
+			if !subjectPatternValid(val) {
+				err = fmt.Errorf("invalid nats subject \"%s\"", val)
+			} else if key == "in" {
+				br.in = append(br.in, val)
+			} else {
+				br.out = append(br.out, val)
+			}
+		default:
+			err = fmt.Errorf("unrecognized nats option \"%s\"", key)
+		}
+		return
+	})
+	if err == nil && len(br.in) == 0 && len(br.out) == 0 {
+		err = fmt.Errorf("expecting at least one \"in\" or \"out\" subject after \"nats\"")
+	}
+	if err != nil {
+		br = nil
+	}
+	return
+}
+
+// init prepares the bridge to forward events dispatched by the specified
+// manager. No connection is made until the bridge is started.
+func (br *natsType) init(m *managerType) {
+	br.poolType.start(m, 1, br.send)
+}
+
+// connect connects to the server and subscribes to the inbound subjects.
+// Once connected, the client reconnects and resubscribes automatically.
+func (br *natsType) connect() (err error) {
+	var conn *nats.Conn
+	conn, err = nats.Connect(br.url, nats.Name("caddy-pubsub"), nats.Timeout(natsTimeout),
+		nats.MaxReconnects(-1))
+	for j := 0; j < len(br.in) && err == nil; j++ {
+		if br.queue == "" {
+			_, err = conn.Subscribe(br.in[j], br.receive)
+		} else {
+			_, err = conn.QueueSubscribe(br.in[j], br.queue, br.receive)
+		}
+	}
+	if err == nil {
+		br.mutex.Lock()
+		br.conn = conn
+		br.mutex.Unlock()
+	} else if conn != nil {
+		conn.Close()
+	}
+	return
+}
+
+// receive publishes a message received from the server as an event. The
+// subject is recorded in the event's metadata, and a payload that is not
+// valid UTF-8 is stored as base64. Messages that violate the block's limits
+// are discarded.
+func (br *natsType) receive(msg *nats.Msg) {
+	evt := eventNew(msg.Subject, "")
+	evt.bodySet(msg.Data, "")
+	evt.Meta = map[string]string{natsSubjectKey: msg.Subject}
+	br.ingest(evt)
+}
+
+// start satisfies the sourceType interface. The connection is made in the
+// background, retrying until it succeeds, so that an unavailable server does
+// not prevent the Caddy server from starting.
+func (br *natsType) start(m *managerType) (err error) {
+	br.done = make(chan struct{})
+	go func() {
+		defer close(br.done)
+		for br.connect() != nil {
+			select {
+			case <-br.stopped():
+				return
+			case <-time.After(natsRetry):
+			}
+		}
+	}()
+	return
+}
+
+// stop satisfies the sourceType and sinkType interfaces. It closes the
+// connection to the server and can safely be called more than once.
+func (br *natsType) stop() {
+	br.stopOnce.Do(func() {
+		br.poolType.stop()
+		if br.done != nil {
+			<-br.done
+		}
+		br.mutex.Lock()
+		if br.conn != nil {
+			br.conn.Close()
+		}
+		br.mutex.Unlock()
+	})
+}
+
+// accept satisfies the sinkType interface. Events that were received from
+// NATS are not sent back. If the queue is full, the event is dead-lettered at
+// once.
+func (br *natsType) accept(evt eventType) {
+	if len(br.out) > 0 && sinkAccepts(br.manager, "*", evt) && evt.Meta[natsSubjectKey] == "" &&
+		br.outbound(evt.Category) && !br.enqueue(evt) {
+		go br.deadLetter(evt, map[string]string{"nats": br.url, "error": "nats queue full"})
+	}
+}
+
+// outbound returns true if the specified category matches an outbound
+// pattern
+func (br *natsType) outbound(category string) bool {
+	for _, pattern := range br.out {
+		if subjectMatch(pattern, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// send publishes an event to the server with its raw body, dead-lettering it
+// if the bridge is not connected or the publication fails
+func (br *natsType) send(evt eventType) {
+	var err error
+	br.mutex.Lock()
+	conn := br.conn
+	br.mutex.Unlock()
+	if conn == nil {
+		err = errNatsConnect
+	} else {
+		err = conn.Publish(evt.Category, evt.payload())
+	}
+	if err != nil {
+		select {
+		case <-br.stopped():
+		default:
+			br.deadLetter(evt, map[string]string{"nats": br.url, "error": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsServerType is a minimal NATS server for testing. Queue groups are
+// ignored.
+type natsServerType struct {
+	ln    net.Listener
+	mutex sync.Mutex
+	// Subject pattern of each subscription by connection and subscription ID
+	subs map[net.Conn]map[string]string
+	// Subject and payload of each message published by a client
+	received []string
+}
+
+// natsServerNew starts a test server on a local port
+func natsServerNew() (ns *natsServerType, err error) {
+	ns = &natsServerType{subs: make(map[net.Conn]map[string]string)}
+	ns.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err == nil {
+		go func() {
+			for {
+				conn, err := ns.ln.Accept()
+				if err != nil {
+					return
+				}
+				go ns.serve(conn)
+			}
+		}()
+	}
+	return
+}
+
+// url returns the address of the server as a URL
+func (ns *natsServerType) url() string {
+	return "nats://" + ns.ln.Addr().String()
+}
+
+// publish sends a message to the subscribers of its subject
+func (ns *natsServerType) publish(subject, payload string) {
+	ns.mutex.Lock()
+	for conn, subs := range ns.subs {
+		for sid, pattern := range subs {
+			if subjectMatch(pattern, subject) {
+				fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+			}
+		}
+	}
+	ns.mutex.Unlock()
+}
+
+// serve handles the commands of a client connection
+func (ns *natsServerType) serve(conn net.Conn) {
+	var line string
+	var err error
+	rd := bufio.NewReader(conn)
+	ns.mutex.Lock()
+	ns.subs[conn] = make(map[string]string)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"version\":\"2.1.0\",\"max_payload\":1048576,\"proto\":1}\r\n")
+	ns.mutex.Unlock()
+	for err == nil {
+		line, err = rd.ReadString('\n')
+		fields := strings.Fields(line)
+		if err != nil || len(fields) == 0 {
+			continue
+		}
+		ns.mutex.Lock()
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "SUB":
+			// SUB subject [queue] sid
+			ns.subs[conn][fields[len(fields)-1]] = fields[1]
+		case "UNSUB":
+			delete(ns.subs[conn], fields[1])
+		}
+		ns.mutex.Unlock()
+		if strings.ToUpper(fields[0]) == "PUB" {
+			var size int
+			size, err = strconv.Atoi(fields[len(fields)-1])
+			buf := make([]byte, size+2)
+			if err == nil {
+				_, err = io.ReadFull(rd, buf)
+			}
+			if err == nil {
+				ns.mutex.Lock()
+				ns.received = append(ns.received, fields[1]+"|"+string(buf[:size]))
+				ns.mutex.Unlock()
+				ns.publish(fields[1], string(buf[:size]))
+			}
+		}
+	}
+	ns.mutex.Lock()
+	delete(ns.subs, conn)
+	ns.mutex.Unlock()
+	conn.Close()
+}
+
+// subscribed returns the number of subscriptions held by clients
+func (ns *natsServerType) subscribed() (count int) {
+	ns.mutex.Lock()
+	for _, subs := range ns.subs {
+		count += len(subs)
+	}
+	ns.mutex.Unlock()
+	return
+}
+
+// receivedGet returns the messages published by clients
+func (ns *natsServerType) receivedGet() (list []string) {
+	ns.mutex.Lock()
+	list = append(list, ns.received...)
+	ns.mutex.Unlock()
+	return
+}
+
+func TestSubjectMatch(t *testing.T) {
+	var err error
+
+	list := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"orders.*.new", "orders.eu.new", true},
+		{"orders.*.new", "orders.eu.paid", false},
+		{"orders.*", "orders.eu.new", false},
+		{"orders.>", "orders.eu.new", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{"orders", "orders", true},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		item := list[j]
+		if subjectMatch(item.pattern, item.subject) != item.match {
+			err = fmt.Errorf("%s, %s: expected %v", item.pattern, item.subject, item.match)
+		}
+	}
+	for _, pattern := range []string{"", "orders..new", "orders.>.new", "orders.n*"} {
+		if err == nil && subjectPatternValid(pattern) {
+			err = fmt.Errorf("%q: expected invalid pattern", pattern)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNats(t *testing.T) {
+	var err error
+	var ns *natsServerType
+	var br *natsType
+	var evts []eventType
+
+	ns, err = natsServerNew()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.ln.Close()
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	rule := ruleType{manager: m}
+	br, err = natsParse([]string{ns.url(), "in=orders.>", "out=commands.>", "out=orders.>"})
+	if err == nil {
+		br.ingest = rule.ingest
+		br.init(m)
+		m.sinks = append(m.sinks, br)
+		err = br.start(m)
+	}
+	if err == nil {
+		defer br.stop()
+		for j := 0; j < 200 && ns.subscribed() == 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		// A backend service publishes
+		ns.publish("orders.eu.new", `{"id":7}`)
+		ns.publish("billing.eu", "ignored")
+		evts = listenEvents(m, "orders.eu.new", 1)
+		if len(evts) != 1 || evts[0].Data != `{"id":7}` || evts[0].Meta[natsSubjectKey] != "orders.eu.new" {
+			err = fmt.Errorf("unexpected inbound events %+v", evts)
+		}
+	}
+	if err == nil {
+		for _, category := range []string{"commands.restart", "chat.room"} {
+			if err == nil {
+				_, err = m.publish(category, "x-"+category)
+			}
+		}
+	}
+	if err == nil {
+		var list []string
+		for j := 0; j < 100 && len(list) < 1; j++ {
+			time.Sleep(10 * time.Millisecond)
+			list = ns.receivedGet()
+		}
+		// The inbound order is not sent back to the server
+		time.Sleep(50 * time.Millisecond)
+		list = ns.receivedGet()
+		str := strings.Join(list, ",")
+		if str != "commands.restart|x-commands.restart" {
+			err = fmt.Errorf("unexpected outbound messages %s", str)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
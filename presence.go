@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Category in which join and leave events are published
+	presenceCategory = "presence"
+	// Default period after its last longpoll ends that a client is still
+	// considered present
+	presenceTimeoutDefault = 30 * time.Second
+	// Maximum length of a client identifier
+	clientIDLenMax = 128
+	// Maximum length of client information
+	clientInfoLenMax = 1024
+)
+
+var errPresenceCategory = errors.New("category is reserved for presence events")
+
+// memberType is a client that is present in a category
+type memberType struct {
+	ID   string `json:"client_id"`
+	Info string `json:"info,omitempty"`
+	// Milliseconds since the Unix epoch
+	Joined int64 `json:"joined"`
+	// Number of longpolls in progress
+	active int
+	// End of the most recent longpoll
+	lastSeen time.Time
+}
+
+// presenceEventType is the body of a join or leave event
+type presenceEventType struct {
+	Action   string `json:"action"`
+	Category string `json:"category"`
+	ID       string `json:"client_id"`
+	Info     string `json:"info,omitempty"`
+}
+
+// presenceType tracks the clients that are subscribed to each category of a
+// manager. A client is present while it has a longpoll in progress and for a
+// grace period after its last longpoll ends, which covers the gap before it
+// polls again.
+type presenceType struct {
+	mutex   sync.Mutex
+	manager *managerType
+	timeout time.Duration
+	// Members by client identifier, by category
+	members map[string]map[string]*memberType
+}
+
+// newPresence returns a presence tracker for the specified manager and starts
+// the sweep that detects departed clients. A timeout of zero selects the
+// default grace period. The sweep ends when the manager is shut down.
+func newPresence(m *managerType, timeout time.Duration) (p *presenceType) {
+	if timeout == 0 {
+		timeout = presenceTimeoutDefault
+	}
+	p = &presenceType{
+		manager: m,
+		timeout: timeout,
+		members: make(map[string]map[string]*memberType),
+	}
+	m.presence = p
+	go p.sweepLoop()
+	return
+}
+
+// announce publishes a join or leave event for the specified member
+func (p *presenceType) announce(action, category string, mbr memberType) {
+	buf, _ := json.Marshal(presenceEventType{
+		Action:   action,
+		Category: category,
+		ID:       mbr.ID,
+		Info:     mbr.Info,
+	})
+	p.manager.dispatch(eventNew(presenceCategory, string(buf)))
+}
+
+// enter records the start of a longpoll by the specified client. A client
+// that was not present is announced with a join event.
+func (p *presenceType) enter(category, id, info string) {
+	var joined memberType
+	p.mutex.Lock()
+	cat, ok := p.members[category]
+	if !ok {
+		cat = make(map[string]*memberType)
+		p.members[category] = cat
+	}
+	mbr, present := cat[id]
+	if !present {
+		mbr = &memberType{ID: id, Joined: msec(time.Now())}
+		cat[id] = mbr
+	}
+	if info != "" {
+		mbr.Info = info
+	}
+	mbr.active++
+	joined = *mbr
+	p.mutex.Unlock()
+	if !present {
+		p.announce("join", category, joined)
+	}
+}
+
+// exit records the end of a longpoll by the specified client
+func (p *presenceType) exit(category, id string) {
+	p.mutex.Lock()
+	if mbr, ok := p.members[category][id]; ok {
+		mbr.active--
+		mbr.lastSeen = time.Now()
+	}
+	p.mutex.Unlock()
+}
+
+// sweep removes clients whose grace period has elapsed and announces their
+// departure with leave events
+func (p *presenceType) sweep(now time.Time) {
+	type leaveType struct {
+		category string
+		mbr      memberType
+	}
+	var leaves []leaveType
+	p.mutex.Lock()
+	for category, cat := range p.members {
+		for id, mbr := range cat {
+			if mbr.active == 0 && now.Sub(mbr.lastSeen) >= p.timeout {
+				leaves = append(leaves, leaveType{category, *mbr})
+				delete(cat, id)
+			}
+		}
+		if len(cat) == 0 {
+			delete(p.members, category)
+		}
+	}
+	p.mutex.Unlock()
+	for _, lv := range leaves {
+		p.announce("leave", lv.category, lv.mbr)
+	}
+}
+
+// sweepLoop sweeps periodically until the manager is shut down
+func (p *presenceType) sweepLoop() {
+	interval := p.timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			p.sweep(now)
+		case <-p.manager.quit:
+			return
+		}
+	}
+}
+
+// list returns the members of the specified category ordered by the time
+// they joined
+func (p *presenceType) list(category string) (list []memberType) {
+	p.mutex.Lock()
+	list = make([]memberType, 0, len(p.members[category]))
+	for _, mbr := range p.members[category] {
+		list = append(list, *mbr)
+	}
+	p.mutex.Unlock()
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Joined == list[b].Joined {
+			return list[a].ID < list[b].ID
+		}
+		return list[a].Joined < list[b].Joined
+	})
+	return
+}
+
+// presenceHandle responds to a request at the presence path. The response is
+// a JSON object that lists the members of the category specified by the
+// "category" query parameter.
+func (p *presenceType) presenceHandle(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	writeJSON(w, struct {
+		Category string       `json:"category"`
+		Members  []memberType `json:"members"`
+	}{category, p.list(category)})
+}
@@ -0,0 +1,66 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	var err error
+	var res eventResponseType
+	var body presenceEventType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	p := newPresence(m, time.Hour)
+	rec := httptest.NewRecorder()
+	m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=doc&client_id=alice&client_info=Alice", nil))
+	p.enter("doc", "bob", "")
+	list := p.list("doc")
+	if len(list) != 2 || list[0].ID != "alice" || list[0].Info != "Alice" || list[1].ID != "bob" {
+		err = fmt.Errorf("unexpected members %+v", list)
+	}
+	if err == nil {
+		// Bob's longpoll is still in progress, so only Alice leaves
+		p.sweep(time.Now().Add(2 * time.Hour))
+		list = p.list("doc")
+		if len(list) != 1 || list[0].ID != "bob" {
+			err = fmt.Errorf("unexpected members after sweep %+v", list)
+		}
+	}
+	if err == nil {
+		rec = httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=presence&since_time=0", nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil && len(res.Events) != 3 {
+			err = fmt.Errorf("expected 3 presence events, got %s", rec.Body.String())
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(res.Events[2].Data), &body)
+			if err == nil && (body != presenceEventType{Action: "leave", Category: "doc", ID: "alice", Info: "Alice"}) {
+				err = fmt.Errorf("unexpected leave event %+v", body)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPresenceShortTimeout(t *testing.T) {
+	// A timeout shorter than the sweep granularity must not stop the sweep
+	hnd, err := handlerGet(`pubsub /publish /subscribe {
+	presence_path /presence
+	presence_timeout 3ns
+}`, "./test")
+	if err == nil {
+		time.Sleep(150 * time.Millisecond)
+		hnd.shutdown()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
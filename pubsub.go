@@ -17,14 +17,20 @@
 package pubsub
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
-	"github.com/jcuga/golongpoll"
 )
 
 type handlerType struct {
@@ -34,10 +40,18 @@ type handlerType struct {
 }
 
 var (
-	errNoBody     = errors.New("publication body missing")
-	errNoCategory = errors.New("publication category missing")
+	errNoBody          = errors.New("publication body missing")
+	errNoCategory      = errors.New("publication category missing")
+	errBodySize        = errors.New("publication body too large")
+	errCategoryPattern = errors.New("category does not match the configured pattern")
+	errCategoryLength  = errors.New("category exceeds the configured length limit")
+	errRecipient       = fmt.Errorf("at most %d recipients of up to %d characters each are allowed",
+		recipientsMax, clientIDLenMax)
 )
 
+// Maximum number of recipients of a direct message
+const recipientsMax = 100
+
 // ruleType represents a pubsub handling rule; it is parsed from the pubsub directive
 // in the Caddyfile
 type ruleType struct {
@@ -45,10 +59,66 @@ type ruleType struct {
 	publishPath string
 	// Subscription path
 	subscribePath string
-	// golongpoll options
-	opt golongpoll.Options
-	// longpoll instance for this block
-	manager *golongpoll.LongpollManager
+	// Optional path at which statistics are reported
+	statsPath string
+	// Maximum size of a publication request body, zero for no limit
+	maxBodySize int64
+	// Maximum length of a category, zero for the manager's limit
+	maxCategoryLength int
+	// Optional pattern that every category must match in full
+	categoryPattern *regexp.Regexp
+	// Optional path at which scheduled events are listed and canceled
+	schedulePath string
+	// Maximum number of scheduled events, zero for the default
+	maxScheduled int
+	// Holds events for delayed delivery
+	scheduler *schedulerType
+	// How long idempotency keys are remembered, zero for the default
+	idempotencyWindow time.Duration
+	// Receipts of recent publications by idempotency key
+	idempotency *idempotencyType
+	// Metadata key under which the authenticated publisher is recorded
+	publisherMeta string
+	// Path at which present clients are listed; presence is tracked only if
+	// this is set
+	presencePath string
+	// Grace period after a client's last longpoll, zero for the default
+	presenceTimeout time.Duration
+	// True if subscribers are identified by their authenticated user name
+	// rather than by a client-supplied identifier
+	authClientID bool
+	// Path at which events are acknowledged; acknowledgements are enabled
+	// only if this is set
+	ackPath string
+	// Optional path at which events are published and their replies awaited
+	requestPath string
+	// Deliver events to HTTP endpoints
+	webhooks []*webhookType
+	// Run local processes for events
+	execSinks []*execSinkType
+	// Produce events from outside of the publish path
+	sources []sourceType
+	// Publish records received on sockets
+	listeners []*listenType
+	// Exchange events with MQTT brokers
+	mqttBridges []*mqttType
+	// Exchange events with NATS servers
+	natsBridges []*natsType
+	// Copy events to other blocks
+	forwards []*forwardType
+	// Modify or drop events before they are published
+	transforms []transformType
+	// Validate the bodies of events in matching categories
+	schemas []*schemaType
+	// Compression of subscription responses; nil if responses are not
+	// compressed
+	compress *compressType
+	// Patterns of categories whose responses are never compressed
+	noCompress []string
+	// Buffering options
+	opt optionsType
+	// Event manager for this block
+	manager *managerType
 }
 
 func init() {
@@ -64,11 +134,33 @@ func init() {
 func configureServer(ctrl *caddy.Controller, cfg *httpserver.SiteConfig) (err error) {
 	var hnd handlerType
 
+	hnd.startup = func() (err error) {
+		for j := 0; j < len(hnd.rules) && err == nil; j++ {
+			rule := &hnd.rules[j]
+			// Blocks that never start do not lower the process-wide limit
+			retention.register(rule.manager)
+			for _, src := range rule.sources {
+				if err == nil {
+					err = src.start(rule.manager)
+				}
+			}
+		}
+		return
+	}
+
 	hnd.shutdown = func() (err error) {
 		for j := 0; j < len(hnd.rules) && err == nil; j++ {
 			rule := &hnd.rules[j]
+			blockUnregister(rule)
+			for _, src := range rule.sources {
+				src.stop()
+			}
+			if rule.scheduler != nil {
+				rule.scheduler.stop()
+				rule.scheduler = nil
+			}
 			if rule.manager != nil {
-				rule.manager.Shutdown()
+				rule.manager.shutdown()
 				rule.manager = nil
 			}
 		}
@@ -79,9 +171,66 @@ func configureServer(ctrl *caddy.Controller, cfg *httpserver.SiteConfig) (err er
 	if err == nil {
 		for j := 0; j < len(hnd.rules) && err == nil; j++ {
 			rule := &hnd.rules[j]
-			rule.manager, err = golongpoll.StartLongpoll(rule.opt)
+			if rule.ackPath == "" {
+				rule.opt.ackTimeout = 0
+			} else if rule.opt.ackTimeout == 0 {
+				rule.opt.ackTimeout = ackTimeoutDefault
+			}
+			rule.manager, err = newManager(rule.opt)
+			if err == nil {
+				rule.scheduler = newScheduler(rule.manager, rule.maxScheduled)
+				rule.idempotency = newIdempotency(rule.idempotencyWindow)
+				if rule.presencePath != "" {
+					newPresence(rule.manager, rule.presenceTimeout)
+				}
+				for _, wh := range rule.webhooks {
+					wh.start(rule.manager)
+					rule.manager.sinks = append(rule.manager.sinks, wh)
+				}
+				for _, snk := range rule.execSinks {
+					snk.start(rule.manager)
+					rule.manager.sinks = append(rule.manager.sinks, snk)
+				}
+				for _, src := range rule.sources {
+					switch src := src.(type) {
+					case *watchType:
+						src.ingest = rule.ingest
+					case *execSourceType:
+						src.ingest = rule.ingest
+					}
+				}
+				for _, ln := range rule.listeners {
+					ln.ingest = rule.ingest
+					ln.scope = ctrl.Context()
+					rule.sources = append(rule.sources, ln)
+				}
+				for _, br := range rule.mqttBridges {
+					br.ingest = rule.ingest
+					br.init(rule.manager)
+					rule.manager.sinks = append(rule.manager.sinks, br)
+					rule.sources = append(rule.sources, br)
+				}
+				for _, br := range rule.natsBridges {
+					br.ingest = rule.ingest
+					br.init(rule.manager)
+					rule.manager.sinks = append(rule.manager.sinks, br)
+					rule.sources = append(rule.sources, br)
+				}
+				for _, fwd := range rule.forwards {
+					fwd.name = cfg.Addr.Host + rule.publishPath
+					fwd.scope = ctrl.Context()
+					fwd.publisherMeta = rule.publisherMeta
+					fwd.init(rule.manager)
+					rule.manager.sinks = append(rule.manager.sinks, fwd)
+					rule.sources = append(rule.sources, fwd)
+				}
+			}
 		}
 		if err == nil {
+			for j := range hnd.rules {
+				blockRegister(ctrl.Context(), cfg.Addr.Host, &hnd.rules[j])
+			}
+			ctrl.OnStartup(hnd.startup)
 			ctrl.OnShutdown(hnd.shutdown)
 			cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
 				hnd.next = next
@@ -98,15 +247,53 @@ func setup(c *caddy.Controller) (err error) {
 	return configureServer(c, httpserver.GetConfig(c))
 }
 
-// pubsubParse parses one or more "pubsub" configuration directives
-func pubsubParseAdvanced(c *caddy.Controller, opt *golongpoll.Options) (err error) {
+// byteSizeParse parses a byte count such as "4096", "64KB" or "2MB". The
+// suffixes KB, MB and GB denote multiples of 1024, 1024^2 and 1024^3.
+func byteSizeParse(str string) (size int64, err error) {
+	var mul int64 = 1
+	upper := strings.ToUpper(str)
+	for _, suffix := range []struct {
+		str string
+		mul int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}} {
+		if strings.HasSuffix(upper, suffix.str) {
+			mul = suffix.mul
+			upper = strings.TrimSuffix(upper, suffix.str)
+			break
+		}
+	}
+	size, err = strconv.ParseInt(upper, 10, 64)
+	if err == nil {
+		if size >= 0 {
+			size *= mul
+		} else {
+			err = fmt.Errorf("byte size \"%s\" must not be negative", str)
+		}
+	}
+	return
+}
+
+// durationParse parses a duration expressed either as a number of seconds or
+// in the form accepted by time.ParseDuration, for example "90s" or "1h30m"
+func durationParse(str string) (dur time.Duration, err error) {
+	var secs int64
+	secs, err = strconv.ParseInt(str, 10, 64)
+	if err == nil {
+		dur = time.Duration(secs) * time.Second
+	} else {
+		dur, err = time.ParseDuration(str)
+	}
+	return
+}
+
+// pubsubParseAdvanced parses the subdirectives of a "pubsub" block
+func pubsubParseAdvanced(c *caddy.Controller, rule *ruleType) (err error) {
+	opt := &rule.opt
 	for err == nil && c.NextBlock() {
 		val := c.Val()
 		args := c.RemainingArgs()
 		argCount := len(args)
 		switch val {
-		// If the "LoggingEnabled" flag is true, golongpoll logs messages to the
-		// global log instance which interferes with caddy's logging mechanism.
 		case "MaxLongpollTimeoutSeconds":
 			if argCount == 1 {
 				opt.MaxLongpollTimeoutSeconds, err = strconv.Atoi(args[0])
@@ -131,6 +318,222 @@ func pubsubParseAdvanced(c *caddy.Controller, opt *golongpoll.Options) (err erro
 			} else {
 				err = fmt.Errorf("unexpected arguments after \"DeleteEventAfterFirstRetrieval\"")
 			}
+		case "max_category_bytes":
+			if argCount == 1 {
+				opt.maxCategoryBytes, err = byteSizeParse(args[0])
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_category_bytes\", got %d", argCount)
+			}
+		case "max_block_bytes":
+			if argCount == 1 {
+				opt.maxBlockBytes, err = byteSizeParse(args[0])
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_block_bytes\", got %d", argCount)
+			}
+		case "max_total_bytes":
+			if argCount == 1 {
+				opt.maxTotalBytes, err = byteSizeParse(args[0])
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_total_bytes\", got %d", argCount)
+			}
+		case "stats_path":
+			if argCount == 1 {
+				rule.statsPath = args[0]
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"stats_path\", got %d", argCount)
+			}
+		case "max_body_size":
+			if argCount == 1 {
+				rule.maxBodySize, err = byteSizeParse(args[0])
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_body_size\", got %d", argCount)
+			}
+		case "max_category_length":
+			if argCount == 1 {
+				rule.maxCategoryLength, err = strconv.Atoi(args[0])
+				if err == nil && (rule.maxCategoryLength < 1 || rule.maxCategoryLength > categoryLenMax) {
+					err = fmt.Errorf("\"max_category_length\" must be 1-%d", categoryLenMax)
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_category_length\", got %d", argCount)
+			}
+		case "category_pattern":
+			if argCount == 1 {
+				// Anchor the expression so that it must match the entire category
+				rule.categoryPattern, err = regexp.Compile("^(?:" + args[0] + ")$")
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"category_pattern\", got %d", argCount)
+			}
+		case "schedule_path":
+			if argCount == 1 {
+				rule.schedulePath = args[0]
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"schedule_path\", got %d", argCount)
+			}
+		case "max_scheduled":
+			if argCount == 1 {
+				rule.maxScheduled, err = strconv.Atoi(args[0])
+				if err == nil && rule.maxScheduled < 1 {
+					err = fmt.Errorf("\"max_scheduled\" must be at least 1")
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_scheduled\", got %d", argCount)
+			}
+		case "idempotency_window":
+			if argCount == 1 {
+				rule.idempotencyWindow, err = durationParse(args[0])
+				if err == nil && rule.idempotencyWindow <= 0 {
+					err = fmt.Errorf("\"idempotency_window\" must be positive")
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"idempotency_window\", got %d", argCount)
+			}
+		case "presence_path":
+			if argCount == 1 {
+				rule.presencePath = args[0]
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"presence_path\", got %d", argCount)
+			}
+		case "presence_timeout":
+			if argCount == 1 {
+				rule.presenceTimeout, err = durationParse(args[0])
+				if err == nil && rule.presenceTimeout <= 0 {
+					err = fmt.Errorf("\"presence_timeout\" must be positive")
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"presence_timeout\", got %d", argCount)
+			}
+		case "authenticated_client_id":
+			if argCount == 0 {
+				rule.authClientID = true
+			} else {
+				err = fmt.Errorf("expecting no arguments after \"authenticated_client_id\", got %d", argCount)
+			}
+		case "webhook":
+			var wh *webhookType
+			wh, err = webhookParse(args)
+			if err == nil {
+				rule.webhooks = append(rule.webhooks, wh)
+			}
+		case "exec":
+			var snk *execSinkType
+			snk, err = execParse(args)
+			if err == nil {
+				rule.execSinks = append(rule.execSinks, snk)
+			}
+		case "watch":
+			var wt *watchType
+			wt, err = watchParse(args)
+			if err == nil {
+				rule.sources = append(rule.sources, wt)
+			}
+		case "listen":
+			var ln *listenType
+			ln, err = listenParse(args)
+			if err == nil {
+				rule.listeners = append(rule.listeners, ln)
+			}
+		case "syslog":
+			var ln *listenType
+			ln, err = syslogParse(args)
+			if err == nil {
+				rule.listeners = append(rule.listeners, ln)
+			}
+		case "mqtt":
+			var br *mqttType
+			br, err = mqttParse(args)
+			if err == nil {
+				rule.mqttBridges = append(rule.mqttBridges, br)
+			}
+		case "nats":
+			var br *natsType
+			br, err = natsParse(args)
+			if err == nil {
+				rule.natsBridges = append(rule.natsBridges, br)
+			}
+		case "forward":
+			var fwd *forwardType
+			fwd, err = forwardParse(args)
+			if err == nil {
+				rule.forwards = append(rule.forwards, fwd)
+			}
+		case "transform":
+			var tr transformType
+			tr, err = transformParse(args)
+			if err == nil {
+				rule.transforms = append(rule.transforms, tr)
+			}
+		case "schema":
+			var sch *schemaType
+			sch, err = schemaParse(args)
+			if err == nil {
+				rule.schemas = append(rule.schemas, sch)
+			}
+		case "compress":
+			rule.compress, err = compressParse(args)
+		case "no_compress":
+			if argCount == 1 {
+				rule.noCompress = append(rule.noCompress, args[0])
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"no_compress\", got %d", argCount)
+			}
+		case "source":
+			var src sourceType
+			src, err = sourceParse(args)
+			if err == nil {
+				rule.sources = append(rule.sources, src)
+			}
+		case "request_path":
+			if argCount == 1 {
+				rule.requestPath = args[0]
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"request_path\", got %d", argCount)
+			}
+		case "ack_path":
+			if argCount == 1 {
+				rule.ackPath = args[0]
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"ack_path\", got %d", argCount)
+			}
+		case "ack_timeout":
+			if argCount == 1 {
+				rule.opt.ackTimeout, err = durationParse(args[0])
+				if err == nil && rule.opt.ackTimeout <= 0 {
+					err = fmt.Errorf("\"ack_timeout\" must be positive")
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"ack_timeout\", got %d", argCount)
+			}
+		case "max_deliveries":
+			if argCount == 1 {
+				rule.opt.maxDeliveries, err = strconv.Atoi(args[0])
+				if err == nil && rule.opt.maxDeliveries < 1 {
+					err = fmt.Errorf("\"max_deliveries\" must be at least 1")
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"max_deliveries\", got %d", argCount)
+			}
+		case "dead_letter_category":
+			if argCount == 1 {
+				rule.opt.deadLetter = args[0]
+				if len(rule.opt.deadLetter) > categoryLenMax {
+					err = errCategoryLen
+				}
+			} else {
+				err = fmt.Errorf("expecting 1 argument after \"dead_letter_category\", got %d", argCount)
+			}
+		case "publisher_meta":
+			switch argCount {
+			case 0:
+				rule.publisherMeta = "publisher"
+			case 1:
+				rule.publisherMeta = strings.ToLower(args[0])
+				if !metaKeyRe.MatchString(rule.publisherMeta) {
+					err = errMetaKey
+				}
+			default:
+				err = fmt.Errorf("expecting 0 or 1 argument after \"publisher_meta\", got %d", argCount)
+			}
 		default:
 			err = fmt.Errorf("unexpected subdirective \"%s\"", val)
 		}
@@ -150,7 +553,7 @@ func pubsubParse(c *caddy.Controller) (rules []ruleType, err error) {
 				if args[0] != args[1] {
 					rule.publishPath = args[0]
 					rule.subscribePath = args[1]
-					err = pubsubParseAdvanced(c, &rule.opt)
+					err = pubsubParseAdvanced(c, &rule)
 				} else {
 					err = fmt.Errorf("publish path and subscribe path must be different")
 				}
@@ -167,37 +570,302 @@ func pubsubParse(c *caddy.Controller) (rules []ruleType, err error) {
 	return
 }
 
+// categoryCheck returns an error if the specified category is empty or
+// violates the configured length limit or pattern
+func (rule *ruleType) categoryCheck(category string) (err error) {
+	switch {
+	case category == "":
+		err = errNoCategory
+	case rule.maxCategoryLength > 0 && len(category) > rule.maxCategoryLength:
+		err = errCategoryLength
+	case rule.categoryPattern != nil && !rule.categoryPattern.MatchString(category):
+		err = errCategoryPattern
+	}
+	return
+}
+
+// bodyLimit reads the request body, failing with errBodySize if it exceeds
+// the configured maximum body size. This is done before the form is parsed so
+// that an oversized request is never buffered in full.
+func (rule *ruleType) bodyLimit(r *http.Request) (err error) {
+	var buf []byte
+	if rule.maxBodySize > 0 && r.Body != nil {
+		if r.ContentLength > rule.maxBodySize {
+			err = errBodySize
+		} else {
+			buf, err = ioutil.ReadAll(io.LimitReader(r.Body, rule.maxBodySize+1))
+			if err == nil {
+				if int64(len(buf)) <= rule.maxBodySize {
+					r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+				} else {
+					err = errBodySize
+				}
+			}
+		}
+	}
+	return
+}
+
+// publishStatus returns the HTTP status code that corresponds to the
+// specified publication error
+func publishStatus(err error) (code int) {
+	switch err {
+	case nil:
+		code = http.StatusOK
+	case errBodySize:
+		code = http.StatusRequestEntityTooLarge
+	case errNoBody, errNoCategory, errCategoryPattern, errCategoryLength, errCategoryLen,
+		errScheduleTime, errScheduleConflict, errIdempotencyKey,
+		errMetaKey, errMetaCount, errMetaValue, errMetaReserve, errPresenceCategory,
+		errRecipient, errRequestTimeout, errEncoding, errBase64, errContentType:
+		code = http.StatusBadRequest
+	case errDropped:
+		code = http.StatusForbidden
+	case errNoReply:
+		code = http.StatusGatewayTimeout
+	case errScheduleFull:
+		code = http.StatusServiceUnavailable
+	case errIdempotencyConflict:
+		code = http.StatusConflict
+	default:
+		if _, ok := err.(*schemaErrorType); ok {
+			code = http.StatusUnprocessableEntity
+		} else {
+			code = http.StatusInternalServerError
+		}
+	}
+	return
+}
+
+// textRespond writes a plain text response with the specified status code.
+// The text is "OK" if err is nil and otherwise describes the error.
+func textRespond(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if err == nil {
+		fmt.Fprintf(w, "OK")
+	} else {
+		fmt.Fprintf(w, "Not OK: %s", err)
+	}
+}
+
+// receiptType identifies an accepted publication
+type receiptType struct {
+	id string
+	// Dispatch time in milliseconds since the Unix epoch, zero if scheduled
+	timestamp int64
+	// Scheduled delivery time in milliseconds since the Unix epoch, zero if
+	// dispatched immediately
+	deliverAt int64
+}
+
+// headerSet reports the receipt in the specified response headers
+func (rc receiptType) headerSet(hdr http.Header) {
+	hdr.Set("Pubsub-Id", rc.id)
+	if rc.deliverAt != 0 {
+		hdr.Set("Pubsub-Deliver-At", strconv.FormatInt(rc.deliverAt, 10))
+	} else {
+		hdr.Set("Pubsub-Timestamp", strconv.FormatInt(rc.timestamp, 10))
+	}
+}
+
+// submit dispatches the specified event or, if the "deliver_at" or "delay"
+// form field specifies a future time, schedules it for later delivery
+func (rule *ruleType) submit(evt eventType, form url.Values) (rc receiptType, err error) {
+	var tm time.Time
+	var scheduled bool
+	var sch scheduledType
+
+	now := time.Now()
+	tm, scheduled, err = deliveryTime(form.Get("deliver_at"), form.Get("delay"), now)
+	if err == nil {
+		if scheduled && tm.After(now) {
+			sch, err = rule.scheduler.add(evt, tm)
+			rc = receiptType{id: sch.ID, deliverAt: sch.DeliverAt}
+		} else {
+			evt, err = rule.manager.dispatch(evt)
+			rc = receiptType{id: evt.ID, timestamp: evt.Timestamp}
+		}
+	}
+	return
+}
+
+// recipientsGet returns the client identifiers listed in the "to" form
+// fields of a publication request. Each field holds one identifier or several
+// separated by commas. A nil list means the event is addressed to every
+// subscriber.
+func recipientsGet(form url.Values) (to []string, err error) {
+	for _, str := range form["to"] {
+		for _, id := range strings.Split(str, ",") {
+			id = strings.TrimSpace(id)
+			if id != "" {
+				if len(id) > clientIDLenMax || len(to) >= recipientsMax {
+					err = errRecipient
+				}
+				to = append(to, id)
+			}
+		}
+	}
+	if err != nil {
+		to = nil
+	}
+	return
+}
+
+// eventCheck returns an error if the category or body of the specified event
+// cannot be published in the block. Categories of pending replies are exempt
+// from the category limits. A binary body is measured by its decoded size.
+func (rule *ruleType) eventCheck(evt eventType) (err error) {
+	category := evt.Category
+	err = rule.categoryCheck(category)
+	switch {
+	case err != nil:
+		if rule.manager.replyPending(category) {
+			// Replies are published in generated categories
+			err = nil
+		}
+	case rule.presencePath != "" && category == presenceCategory:
+		err = errPresenceCategory
+	}
+	switch {
+	case err != nil:
+	case evt.Data == "":
+		err = errNoBody
+	case rule.maxBodySize > 0 && evt.bodySize() > rule.maxBodySize:
+		err = errBodySize
+	}
+	return
+}
+
+// eventGet returns the event described by a publication request. The
+// request's category, body, metadata and recipients are checked against the
+// block's limits, the block's transforms are applied, and the result is
+// checked against the block's schemas. errDropped is returned if a transform
+// drops the event. The body may be binary; see bodyGet.
+func (rule *ruleType) eventGet(r *http.Request) (evt eventType, err error) {
+	err = rule.bodyLimit(r)
+	if err == nil {
+		err = r.ParseForm()
+	}
+	if err == nil {
+		evt, err = bodyGet(r)
+	}
+	if err == nil {
+		evt.Category = r.Form.Get("category")
+		evt.ID = idNew()
+		err = rule.eventCheck(evt)
+		if err == nil {
+			evt.Meta, err = rule.metaGet(r)
+			if err == nil {
+				evt.To, err = recipientsGet(r.Form)
+			}
+			if err == nil {
+				user, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string)
+				evt, err = rule.transform(evt, user)
+			}
+			if err == nil {
+				err = rule.schemaCheck(evt)
+			}
+		}
+	}
+	return
+}
+
+// publishHandle responds to a publication request. On success, the response
+// headers Pubsub-Id and either Pubsub-Timestamp or, for an event scheduled
+// for later delivery, Pubsub-Deliver-At identify the event. If the request
+// repeats the idempotency key of a recent publication by the same user, the
+// original receipt is returned along with the header Pubsub-Duplicate and
+// nothing is published.
+func (rule *ruleType) publishHandle(w http.ResponseWriter, r *http.Request) (err error) {
+	var evt eventType
+	var rc receiptType
+	var dup bool
+
+	evt, err = rule.eventGet(r)
+	if err == nil {
+		user, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string)
+		rc, dup, err = rule.idempotency.do(user, r.Form.Get("idempotency_key"), idempotencyDigest(evt),
+			func() (receiptType, error) {
+				return rule.submit(evt, r.Form)
+			})
+	}
+	if err == nil {
+		rc.headerSet(w.Header())
+		if dup {
+			w.Header().Set("Pubsub-Duplicate", "true")
+		}
+	} else if err == errDropped {
+		w.Header().Set("Pubsub-Dropped", "true")
+		err = nil
+	}
+	textRespond(w, publishStatus(err), err)
+	return
+}
+
+// clientIDSet replaces any client identifier in the request with the name
+// of the authenticated user, or removes it if the request is not
+// authenticated, if the block is configured to identify clients by user
+func (rule *ruleType) clientIDSet(r *http.Request) {
+	if rule.authClientID {
+		user, _ := r.Context().Value(httpserver.RemoteUserCtxKey).(string)
+		query := r.URL.Query()
+		query.Del("client_id")
+		if r.ParseForm() == nil {
+			r.Form.Del("client_id")
+		}
+		if user != "" {
+			query.Set("client_id", user)
+			r.Form.Set("client_id", user)
+		}
+		r.URL.RawQuery = query.Encode()
+	}
+}
+
 // ServeHTTP satisfies the httpserver.Handler interface.
 func (h handlerType) ServeHTTP(w http.ResponseWriter, r *http.Request) (code int, err error) {
 	for _, rule := range h.rules {
 		if httpserver.Path(r.URL.Path).Matches(rule.subscribePath) {
-			// The following call blocks until an event is published or the call times out
-			rule.manager.SubscriptionHandler(w, r)
-			return
-		} else if httpserver.Path(r.URL.Path).Matches(rule.publishPath) {
-			err = r.ParseForm()
-			if err == nil {
-				category := r.Form.Get("category")
-				if category != "" {
-					body := r.Form.Get("body")
-					if body != "" {
-						err = rule.manager.Publish(category, body)
-					} else {
-						err = errNoBody
-					}
-				} else {
-					err = errNoCategory
-				}
+			category := r.URL.Query().Get("category")
+			rule.clientIDSet(r)
+			// The presence category is exempt from the category checks
+			if category != "" && !(rule.presencePath != "" && category == presenceCategory) {
+				err = rule.categoryCheck(category)
 			}
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			if err == nil {
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintf(w, "OK")
+				// The following call blocks until an event is published or the call times out
+				cw := rule.compressWriter(w, r, category)
+				rule.manager.subscriptionHandler(cw, r)
+				cw.finish()
 			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "Not OK")
+				format := formatNegotiate(r)
+				format.headerSet(w.Header())
+				w.WriteHeader(http.StatusBadRequest)
+				format.write(w, map[string]string{"error": err.Error()})
 			}
 			return
+		} else if httpserver.Path(r.URL.Path).Matches(rule.publishPath) {
+			err = rule.publishHandle(w, r)
+			return
+		} else if rule.schedulePath != "" && httpserver.Path(r.URL.Path).Matches(rule.schedulePath) {
+			err = rule.scheduler.scheduleHandle(w, r)
+			return
+		} else if rule.requestPath != "" && httpserver.Path(r.URL.Path).Matches(rule.requestPath) {
+			// The following call blocks until a reply is published or the call times out
+			err = rule.requestHandle(w, r)
+			return
+		} else if rule.ackPath != "" && httpserver.Path(r.URL.Path).Matches(rule.ackPath) {
+			rule.clientIDSet(r)
+			err = rule.manager.ackHandle(w, r)
+			return
+		} else if rule.presencePath != "" && httpserver.Path(r.URL.Path).Matches(rule.presencePath) {
+			rule.manager.presence.presenceHandle(w, r)
+			return
+		} else if rule.statsPath != "" && httpserver.Path(r.URL.Path).Matches(rule.statsPath) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+			writeJSON(w, rule.manager.snapshot())
+			return
 		}
 	}
 	return h.next.ServeHTTP(w, r)
@@ -1,9 +1,12 @@
 package pubsub
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
@@ -86,6 +89,204 @@ func TestSetup(t *testing.T) {
 }`,
 		`1:pubsub /publish /subscribe {
 	foo bar
+}`,
+		`0:pubsub /publish /subscribe {
+	max_category_bytes 64KB
+	max_block_bytes 1MB
+	max_total_bytes 4096
+	stats_path /stats
+}`,
+		`1:pubsub /publish /subscribe {
+	max_category_bytes
+}`,
+		`1:pubsub /publish /subscribe {
+	max_block_bytes 12XB
+}`,
+		`1:pubsub /publish /subscribe {
+	max_total_bytes -5
+}`,
+		`1:pubsub /publish /subscribe {
+	stats_path /stats /more
+}`,
+		`1:pubsub /publish /subscribe {
+	MaxEventBufferSize -1
+}`,
+		`0:pubsub /publish /subscribe {
+	max_body_size 4KB
+	max_category_length 32
+	category_pattern [a-z]+(\.[a-z]+)*
+}`,
+		`1:pubsub /publish /subscribe {
+	max_category_length 0
+}`,
+		`1:pubsub /publish /subscribe {
+	category_pattern [a-z
+}`,
+		`1:pubsub /publish /subscribe {
+	max_body_size
+}`,
+		`0:pubsub /publish /subscribe {
+	schedule_path /scheduled
+	max_scheduled 50
+}`,
+		`1:pubsub /publish /subscribe {
+	max_scheduled 0
+}`,
+		`1:pubsub /publish /subscribe {
+	schedule_path
+}`,
+		`0:pubsub /publish /subscribe {
+	idempotency_window 10m
+}`,
+		`0:pubsub /publish /subscribe {
+	idempotency_window 600
+}`,
+		`1:pubsub /publish /subscribe {
+	idempotency_window 0
+}`,
+		`1:pubsub /publish /subscribe {
+	idempotency_window soon
+}`,
+		`0:pubsub /publish /subscribe {
+	publisher_meta
+}`,
+		`0:pubsub /publish /subscribe {
+	publisher_meta Sender
+}`,
+		`1:pubsub /publish /subscribe {
+	publisher_meta "bad key"
+}`,
+		`1:pubsub /publish /subscribe {
+	publisher_meta a b
+}`,
+		`0:pubsub /publish /subscribe {
+	presence_path /presence
+	presence_timeout 45s
+}`,
+		`1:pubsub /publish /subscribe {
+	presence_path
+}`,
+		`1:pubsub /publish /subscribe {
+	presence_timeout -1
+}`,
+		`0:pubsub /publish /subscribe {
+	authenticated_client_id
+}`,
+		`1:pubsub /publish /subscribe {
+	authenticated_client_id yes
+}`,
+		`0:pubsub /publish /subscribe {
+	ack_path /ack
+	ack_timeout 1m
+	max_deliveries 3
+	dead_letter_category failed
+}`,
+		`1:pubsub /publish /subscribe {
+	max_deliveries 0
+}`,
+		`1:pubsub /publish /subscribe {
+	ack_timeout
+}`,
+		`0:pubsub /publish /subscribe {
+	request_path /request
+}`,
+		`1:pubsub /publish /subscribe {
+	request_path
+}`,
+		`0:pubsub /publish /subscribe {
+	webhook orders.* https://example.com/hook secret=abc concurrency=2
+	webhook * http://127.0.0.1:8080/all
+}`,
+		`1:pubsub /publish /subscribe {
+	webhook orders.*
+}`,
+		`0:pubsub /publish /subscribe {
+	exec ops.* timeout=1m concurrency=2 sh /etc/caddy/notify.sh
+}`,
+		`1:pubsub /publish /subscribe {
+	exec ops.* no-such-command-for-pubsub
+}`,
+		`1:pubsub /publish /subscribe {
+	exec ops.* timeout=soon notify
+}`,
+		`0:pubsub /publish /subscribe {
+	watch /var/spool/jobs files debounce=1s recursive=true
+}`,
+		`1:pubsub /publish /subscribe {
+	watch /var/spool/jobs
+}`,
+		`0:pubsub /publish /subscribe {
+	source exec logs backoff=5s tail -f /var/log/syslog
+}`,
+		`1:pubsub /publish /subscribe {
+	source exec logs no-such-command-for-pubsub
+}`,
+		`1:pubsub /publish /subscribe {
+	source exec logs backoff=5s
+}`,
+		`1:pubsub /publish /subscribe {
+	source tail logs
+}`,
+		`0:pubsub /publish /subscribe {
+	listen unix /run/pubsub.sock mode=0660
+	listen udp 127.0.0.1:5140
+}`,
+		`1:pubsub /publish /subscribe {
+	listen tcp 127.0.0.1:5140
+}`,
+		`0:pubsub /publish /subscribe {
+	syslog 127.0.0.1:5514 network=tcp category=logs.{app_name}.{severity}
+}`,
+		`1:pubsub /publish /subscribe {
+	syslog 127.0.0.1:5514 category=logs.{host}
+}`,
+		`0:pubsub /publish /subscribe {
+	mqtt tcp://127.0.0.1:1883 client_id=dash qos=1 in=sensors/+/temp "out=alerts/#"
+}`,
+		`1:pubsub /publish /subscribe {
+	mqtt tcp://127.0.0.1:1883 "in=sensors/#/temp"
+}`,
+		`1:pubsub /publish /subscribe {
+	mqtt tcp://127.0.0.1:1883 qos=1
+}`,
+		`0:pubsub /publish /subscribe {
+	nats nats://127.0.0.1:4222 in=orders.> in=inventory.*.low out=commands.> queue=web
+}`,
+		`0:pubsub /publish /subscribe {
+	nats nats://127.0.0.1:4222 out=commands.>
+}`,
+		`1:pubsub /publish /subscribe {
+	nats nats://127.0.0.1:4222 queue=web
+}`,
+		`1:pubsub /publish /subscribe {
+	nats nats://127.0.0.1:4222 in=orders.>.new
+}`,
+		`0:pubsub /publish /subscribe {
+	forward orders.* /internal/publish internal.{1}
+}`,
+		`1:pubsub /publish /subscribe {
+	forward orders.*
+}`,
+		`0:pubsub /publish /subscribe {
+	transform rename raw.* clean.{1}
+	transform redact data.password
+	transform drop data.level==debug
+}`,
+		`1:pubsub /publish /subscribe {
+	transform redact password
+}`,
+		`1:pubsub /publish /subscribe {
+	schema orders.* /nonexistent/order.json
+}`,
+		`0:pubsub /publish /subscribe {
+	compress min_size=4KB level=5
+	no_compress ticks.*
+}`,
+		`1:pubsub /publish /subscribe {
+	compress level=11
+}`,
+		`1:pubsub /publish /subscribe {
+	no_compress
 }`,
 	}
 
@@ -139,6 +340,9 @@ func TestServe(t *testing.T) {
 	var srv *httptest.Server
 	directiveList := []string{
 		`pubsub /publish /subscribe`,
+		`pubsub /publish /subscribe {
+	stats_path /stats
+}`,
 	}
 
 	requestList := []string{
@@ -147,9 +351,10 @@ func TestServe(t *testing.T) {
 		"/publish?category=demo",
 		"/not_a_pubsub",
 		"/subscribe?timeout=1&category=test",
+		"/stats",
 	}
 
-	expectStr := `++-+-+++++`
+	expectStr := `++-+-+++++++` + `++-+-+++++++`
 
 	setErrorFlag := func(err error) {
 		var c byte
@@ -195,3 +400,107 @@ func TestServe(t *testing.T) {
 	}
 
 }
+
+func TestPublishStatus(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	max_body_size 32
+	max_category_length 10
+	category_pattern [a-z]+(\.[a-z]+)*
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		long := strings.Repeat("x", 33)
+		list := []struct {
+			method, url, content string
+			code                 int
+		}{
+			{"GET", "/publish?category=chat.team&body=hello", "", http.StatusOK},
+			{"GET", "/publish?category=chat.team&body=" + long, "", http.StatusRequestEntityTooLarge},
+			{"POST", "/publish", "category=chat&body=" + long, http.StatusRequestEntityTooLarge},
+			{"POST", "/publish", "category=chat&body=hello", http.StatusOK},
+			{"GET", "/publish?category=Chat&body=hello", "", http.StatusBadRequest},
+			{"GET", "/publish?category=chat.general&body=hello", "", http.StatusBadRequest},
+			{"GET", "/publish?body=hello", "", http.StatusBadRequest},
+			{"GET", "/publish?category=chat", "", http.StatusBadRequest},
+			{"GET", "/subscribe?timeout=1&category=chat..team", "", http.StatusBadRequest},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			req := httptest.NewRequest(list[j].method, list[j].url, strings.NewReader(list[j].content))
+			if list[j].content != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, req)
+			if rec.Code != list[j].code {
+				err = fmt.Errorf("%s %s: expected status %d, got %d", list[j].method, list[j].url, list[j].code, rec.Code)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirect(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var res eventResponseType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	authenticated_client_id
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		for _, str := range []string{"to=alice", "to=bob,carol", "to=alice&to=carol", "x=1"} {
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/publish?category=dm&body="+str[:1]+"&"+str, nil))
+			if rec.Code != http.StatusOK && err == nil {
+				err = fmt.Errorf("%s: unexpected status %d", str, rec.Code)
+			}
+		}
+		list := []struct {
+			user, bodies string
+		}{
+			{"alice", "ttx"},
+			{"bob", "tx"},
+			{"carol", "ttx"},
+			{"", "x"},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			// A client-supplied identifier is ignored in favor of the
+			// authenticated user name
+			req := httptest.NewRequest("GET", "/subscribe?timeout=1&category=dm&since_time=0&client_id=alice", nil)
+			if list[j].user != "" {
+				req = req.WithContext(context.WithValue(req.Context(), httpserver.RemoteUserCtxKey, list[j].user))
+			}
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, req)
+			err = json.Unmarshal(rec.Body.Bytes(), &res)
+			if err == nil {
+				var bodies string
+				for _, evt := range res.Events {
+					bodies += evt.Data
+				}
+				if bodies != list[j].bodies {
+					err = fmt.Errorf("user %q: expected %q, got %q", list[j].user, list[j].bodies, bodies)
+				} else if strings.Contains(rec.Body.String(), "carol") {
+					err = fmt.Errorf("user %q: recipient list revealed", list[j].user)
+				}
+			}
+		}
+	}
+	if err == nil {
+		_, err = recipientsGet(url.Values{"to": {strings.Repeat("a,", recipientsMax+1)}})
+		if err == errRecipient {
+			err = nil
+		} else {
+			err = fmt.Errorf("expected recipient error, got %v", err)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Prefix of the categories generated for replies
+	replyPrefix = "reply."
+	// Default number of seconds a request waits for its reply
+	requestTimeoutDefault = 30
+)
+
+var (
+	errNoReply        = errors.New("no reply before timeout")
+	errRequestTimeout = errors.New("invalid timeout")
+)
+
+// replyOpen generates a reply category and registers it so that replies can
+// be published in it regardless of the block's category checks
+func (m *managerType) replyOpen() (category string) {
+	category = replyPrefix + idNew()
+	m.lock()
+	if m.replies == nil {
+		m.replies = make(map[string]bool)
+	}
+	m.replies[category] = true
+	m.mutex.Unlock()
+	return
+}
+
+// replyClose unregisters the specified reply category and discards any
+// events retained in it
+func (m *managerType) replyClose(category string) {
+	m.lock()
+	delete(m.replies, category)
+	if cat := m.categories[category]; cat != nil {
+		for cat.events.Len() > 0 {
+			m.remove(cat.events.Front().Value.(*entryType))
+		}
+	}
+	m.mutex.Unlock()
+}
+
+// replyPending returns true if the specified category awaits a reply
+func (m *managerType) replyPending(category string) (ok bool) {
+	m.lock()
+	ok = m.replies[category]
+	m.mutex.Unlock()
+	return
+}
+
+// requestHandle responds to a request at the request path. The event
+// described by the request is published with the metadata "reply_to", naming
+// a generated reply category, and "correlation_id", which is the event's
+// identifier. The call then blocks until an event with the same
+// correlation_id metadata is published in the reply category, or until the
+// number of seconds given by the "timeout" form field elapses. The reply is
+// returned as an event encoded in the format preferred by the Accept header.
+func (rule *ruleType) requestHandle(w http.ResponseWriter, r *http.Request) (err error) {
+	var evt eventType
+	var replies []eventType
+	var timeout int
+
+	m := rule.manager
+	evt, err = rule.eventGet(r)
+	if err == nil {
+		timeout = requestTimeoutDefault
+		if timeout > m.opt.MaxLongpollTimeoutSeconds {
+			timeout = m.opt.MaxLongpollTimeoutSeconds
+		}
+		if str := r.Form.Get("timeout"); str != "" {
+			timeout, err = strconv.Atoi(str)
+			if err != nil || timeout < 1 || timeout > m.opt.MaxLongpollTimeoutSeconds {
+				err = errRequestTimeout
+			}
+		}
+	}
+	if err == nil {
+		category := m.replyOpen()
+		if evt.Meta == nil {
+			evt.Meta = make(map[string]string)
+		}
+		evt.Meta["reply_to"] = category
+		evt.Meta["correlation_id"] = evt.ID
+		sel := selectorType{filter: filterType{{meta: true, path: []string{"correlation_id"},
+			op: "==", val: evt.ID, text: evt.ID}}}
+		sinceTime := msec(time.Now()) - 1
+		evt, err = m.dispatch(evt)
+		if err == nil {
+			replies, err = m.wait(r.Context(), category, sinceTime, sel, time.Duration(timeout)*time.Second)
+		}
+		m.replyClose(category)
+		if err == nil && len(replies) == 0 {
+			err = errNoReply
+		}
+	}
+	if err == nil {
+		w.Header().Set("Pubsub-Id", evt.ID)
+		format := formatNegotiate(r)
+		format.headerSet(w.Header())
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		format.write(w, replies[0])
+	} else if r.Context().Err() == nil {
+		textRespond(w, publishStatus(err), err)
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+	var err error
+	var hnd handlerType
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	request_path /request
+	category_pattern [a-z]+
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		// The responder waits for a request and publishes its reply
+		go func() {
+			var res eventResponseType
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/subscribe?timeout=5&category=rpc", nil))
+			if json.Unmarshal(rec.Body.Bytes(), &res) == nil && len(res.Events) == 1 {
+				meta := res.Events[0].Meta
+				form := url.Values{
+					"category":            {meta["reply_to"]},
+					"body":                {"pong"},
+					"meta.correlation_id": {meta["correlation_id"]},
+				}
+				hnd.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/publish?"+form.Encode(), nil))
+			}
+		}()
+		for hnd.rules[0].manager.snapshot().Subscribers == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		var reply eventType
+		rec := httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest("GET", "/request?category=rpc&body=ping&timeout=5", nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &reply)
+		if err == nil && (rec.Code != http.StatusOK || reply.Data != "pong" ||
+			reply.Meta["correlation_id"] != rec.Header().Get("Pubsub-Id")) {
+			err = fmt.Errorf("unexpected reply %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if err == nil {
+		list := []struct {
+			url  string
+			code int
+		}{
+			{"/request?category=rpc&body=ping&timeout=1", http.StatusGatewayTimeout},
+			{"/request?category=rpc&body=ping&timeout=0", http.StatusBadRequest},
+			{"/publish?category=reply.0123456789abcdef&body=x", http.StatusBadRequest},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("GET", list[j].url, nil))
+			if rec.Code != list[j].code {
+				err = fmt.Errorf("%s: expected status %d, got %d", list[j].url, list[j].code, rec.Code)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default maximum number of events that a block holds for later delivery
+const scheduledMaxDefault = 1000
+
+var (
+	errScheduleTime     = errors.New("invalid delivery time")
+	errScheduleConflict = errors.New("specify either deliver_at or delay, not both")
+	errScheduleFull     = errors.New("too many scheduled events")
+	errScheduleNotFound = errors.New("scheduled event not found")
+)
+
+// scheduledType is an event held for delivery at a later time
+type scheduledType struct {
+	eventType
+	// Milliseconds since the Unix epoch
+	DeliverAt int64 `json:"deliver_at"`
+	timer     *time.Timer
+}
+
+// schedulerType holds events until their delivery time and then dispatches
+// them with its manager. Scheduled events are kept in memory only; they are
+// lost when the server stops or its configuration is reloaded.
+type schedulerType struct {
+	mutex   sync.Mutex
+	manager *managerType
+	max     int
+	events  map[string]*scheduledType
+	stopped bool
+}
+
+// newScheduler returns a scheduler that dispatches events with the specified
+// manager and holds no more than max events at a time
+func newScheduler(m *managerType, max int) *schedulerType {
+	if max == 0 {
+		max = scheduledMaxDefault
+	}
+	return &schedulerType{
+		manager: m,
+		max:     max,
+		events:  make(map[string]*scheduledType),
+	}
+}
+
+// deliveryTime interprets the "deliver_at" and "delay" publication fields.
+// deliver_at is either an RFC 3339 time or a number of milliseconds since the
+// Unix epoch. delay is interpreted by durationParse. If neither is specified,
+// ok is false.
+func deliveryTime(deliverAt, delay string, now time.Time) (tm time.Time, ok bool, err error) {
+	var ms int64
+	var dur time.Duration
+	switch {
+	case deliverAt != "" && delay != "":
+		err = errScheduleConflict
+	case deliverAt != "":
+		ms, err = strconv.ParseInt(deliverAt, 10, 64)
+		if err == nil {
+			tm = time.Unix(0, ms*int64(time.Millisecond))
+		} else {
+			tm, err = time.Parse(time.RFC3339, deliverAt)
+		}
+		ok = err == nil
+	case delay != "":
+		dur, err = durationParse(delay)
+		if err == nil && dur < 0 {
+			err = errScheduleTime
+		}
+		tm = now.Add(dur)
+		ok = err == nil
+	}
+	if err != nil && err != errScheduleConflict {
+		err = errScheduleTime
+	}
+	return
+}
+
+// add holds the specified event for delivery at the specified time. The
+// event's size counts toward the byte limits of the block and the process
+// until it is dispatched or canceled. The returned entry describes the
+// scheduled event.
+func (s *schedulerType) add(evt eventType, tm time.Time) (sch scheduledType, err error) {
+	s.mutex.Lock()
+	switch {
+	case s.stopped:
+		err = errShutdown
+	case len(s.events) >= s.max || !s.manager.reserve(evt.size()):
+		err = errScheduleFull
+	default:
+		ptr := &scheduledType{eventType: evt, DeliverAt: msec(tm)}
+		s.events[evt.ID] = ptr
+		ptr.timer = time.AfterFunc(time.Until(tm), func() { s.release(evt.ID) })
+		sch = *ptr
+	}
+	s.mutex.Unlock()
+	return
+}
+
+// release dispatches the scheduled event with the specified identifier if it
+// has not been canceled
+func (s *schedulerType) release(id string) {
+	s.mutex.Lock()
+	sch, ok := s.events[id]
+	if ok {
+		delete(s.events, id)
+	}
+	s.mutex.Unlock()
+	if ok {
+		s.manager.unreserve(sch.size())
+		s.manager.dispatch(sch.eventType)
+	}
+}
+
+// cancel removes the scheduled event with the specified identifier
+func (s *schedulerType) cancel(id string) (err error) {
+	s.mutex.Lock()
+	sch, ok := s.events[id]
+	if ok {
+		sch.timer.Stop()
+		delete(s.events, id)
+		s.manager.unreserve(sch.size())
+	} else {
+		err = errScheduleNotFound
+	}
+	s.mutex.Unlock()
+	return
+}
+
+// list returns the pending scheduled events in order of delivery time
+func (s *schedulerType) list() (list []scheduledType) {
+	s.mutex.Lock()
+	list = make([]scheduledType, 0, len(s.events))
+	for _, sch := range s.events {
+		list = append(list, *sch)
+	}
+	s.mutex.Unlock()
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].DeliverAt < list[b].DeliverAt
+	})
+	return
+}
+
+// stop cancels all pending scheduled events
+func (s *schedulerType) stop() {
+	s.mutex.Lock()
+	for id, sch := range s.events {
+		sch.timer.Stop()
+		delete(s.events, id)
+		s.manager.unreserve(sch.size())
+	}
+	s.stopped = true
+	s.mutex.Unlock()
+}
+
+// scheduleHandle responds to a request at the schedule path. A GET request
+// lists the pending scheduled events. A DELETE request with an "id" query
+// parameter, or a POST request with an "id" form field, cancels the specified
+// event.
+func (s *schedulerType) scheduleHandle(w http.ResponseWriter, r *http.Request) (err error) {
+	var code int
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		writeJSON(w, struct {
+			Scheduled []scheduledType `json:"scheduled"`
+		}{s.list()})
+		return
+	case "DELETE", "POST":
+		err = r.ParseForm()
+		if err == nil {
+			err = s.cancel(r.Form.Get("id"))
+		}
+		switch err {
+		case nil:
+			code = http.StatusOK
+		case errScheduleNotFound:
+			code = http.StatusNotFound
+		default:
+			code = http.StatusBadRequest
+		}
+	default:
+		code = http.StatusMethodNotAllowed
+		err = errors.New("method not allowed")
+	}
+	textRespond(w, code, err)
+	return
+}
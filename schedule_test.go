@@ -0,0 +1,165 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeliveryTime(t *testing.T) {
+	var err error
+	now := time.Unix(1500000000, 0)
+	list := []struct {
+		deliverAt, delay string
+		tm               time.Time
+		ok               bool
+		err              error
+	}{
+		{"", "", time.Time{}, false, nil},
+		{"1500000060000", "", now.Add(time.Minute), true, nil},
+		{"2017-07-14T02:41:00Z", "", now.Add(time.Minute), true, nil},
+		{"", "60", now.Add(time.Minute), true, nil},
+		{"", "1m30s", now.Add(90 * time.Second), true, nil},
+		{"", "-5", time.Time{}, false, errScheduleTime},
+		{"tomorrow", "", time.Time{}, false, errScheduleTime},
+		{"1500000060000", "60", time.Time{}, false, errScheduleConflict},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		tm, ok, e := deliveryTime(list[j].deliverAt, list[j].delay, now)
+		if e != list[j].err || ok != list[j].ok || (ok && !tm.Equal(list[j].tm)) {
+			err = fmt.Errorf("deliver_at %q, delay %q: got %v, %v, %v", list[j].deliverAt, list[j].delay, tm, ok, e)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var id string
+	var list struct {
+		Scheduled []scheduledType `json:"scheduled"`
+	}
+
+	serve := func(method, url string) (rec *httptest.ResponseRecorder) {
+		rec = httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return
+	}
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	schedule_path /scheduled
+	max_scheduled 2
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		rec := serve("GET", "/publish?category=demo&body=later&delay=1h")
+		id = rec.Header().Get("Pubsub-Id")
+		if rec.Code != http.StatusOK || id == "" || rec.Header().Get("Pubsub-Deliver-At") == "" {
+			err = fmt.Errorf("scheduled publication failed with status %d", rec.Code)
+		}
+	}
+	if err == nil {
+		rec := serve("GET", "/publish?category=demo&body=soon&delay=50ms")
+		if rec.Code != http.StatusOK {
+			err = fmt.Errorf("scheduled publication failed with status %d", rec.Code)
+		}
+	}
+	if err == nil {
+		rec := serve("GET", "/publish?category=demo&body=full&delay=1h")
+		if rec.Code != http.StatusServiceUnavailable {
+			err = fmt.Errorf("expected schedule to be full, got status %d", rec.Code)
+		}
+	}
+	if err == nil {
+		err = json.Unmarshal(serve("GET", "/scheduled").Body.Bytes(), &list)
+		if err == nil && (len(list.Scheduled) != 2 || list.Scheduled[1].ID != id) {
+			err = fmt.Errorf("unexpected schedule list %+v", list)
+		}
+	}
+	if err == nil {
+		time.Sleep(100 * time.Millisecond)
+		st := hnd.rules[0].manager.snapshot()
+		if st.Published != 1 {
+			err = fmt.Errorf("expected 1 released event, got %d", st.Published)
+		}
+	}
+	if err == nil {
+		if code := serve("DELETE", "/scheduled?id="+id).Code; code != http.StatusOK {
+			err = fmt.Errorf("cancel failed with status %d", code)
+		} else if code = serve("DELETE", "/scheduled?id="+id).Code; code != http.StatusNotFound {
+			err = fmt.Errorf("expected second cancel to fail, got status %d", code)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScheduleBytes(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var id string
+
+	serve := func(url string) (rec *httptest.ResponseRecorder) {
+		rec = httptest.NewRecorder()
+		hnd.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		return
+	}
+
+	// Each event is 14 bytes
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	schedule_path /scheduled
+	max_block_bytes 30
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		m := hnd.rules[0].manager
+		codes := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusServiceUnavailable}
+		for j, url := range []string{
+			"/publish?category=demo&body=0123456789",
+			"/publish?category=demo&body=0123456789&delay=1h",
+			"/publish?category=demo&body=0123456789&delay=1h",
+			"/publish?category=demo&body=0123456789&delay=1h",
+		} {
+			if err == nil {
+				rec := serve(url)
+				if rec.Code != codes[j] {
+					err = fmt.Errorf("%d: unexpected status %d", j, rec.Code)
+				}
+			}
+		}
+		if err == nil {
+			// Scheduled events make room for themselves by evicting
+			// retained ones
+			st := m.snapshot()
+			if st.Events != 0 || st.Evicted != 1 {
+				err = fmt.Errorf("unexpected statistics %+v", st)
+			}
+		}
+		if err == nil {
+			// Canceling an event releases its bytes
+			for _, sch := range hnd.rules[0].scheduler.list() {
+				id = sch.ID
+			}
+			hnd.rules[0].scheduler.cancel(id)
+			if code := serve("/publish?category=demo&body=0123456789&delay=1h").Code; code != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d after cancel", code)
+			}
+		}
+		if err == nil {
+			hnd.rules[0].scheduler.stop()
+			if m.reserved != 0 {
+				err = fmt.Errorf("expected no reserved bytes after stop, got %d", m.reserved)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
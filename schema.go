@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Maximum number of validation errors reported for a rejected event
+const schemaErrorsMax = 10
+
+// schemaType requires the bodies of events in matching categories to conform
+// to a JSON Schema
+type schemaType struct {
+	pattern string
+	file    string
+	schema  *gojsonschema.Schema
+}
+
+// schemaErrorType reports the ways in which a body fails to conform to a
+// schema
+type schemaErrorType struct {
+	pattern string
+	list    []string
+}
+
+// Error satisfies the error interface
+func (e *schemaErrorType) Error() string {
+	return fmt.Sprintf("body does not conform to the schema for \"%s\": %s", e.pattern, strings.Join(e.list, "; "))
+}
+
+// schemaParse parses the arguments of a schema subdirective, a category
+// pattern and the name of a local JSON Schema file, and loads the schema
+func schemaParse(args []string) (sch *schemaType, err error) {
+	var abs string
+	if len(args) != 2 {
+		err = fmt.Errorf("expecting 2 arguments after \"schema\", got %d", len(args))
+		return
+	}
+	sch = &schemaType{pattern: args[0], file: args[1]}
+	abs, err = filepath.Abs(sch.file)
+	if err == nil {
+		// A file reference lets the schema refer to neighboring files
+		sch.schema, err = gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+		if err != nil {
+			err = fmt.Errorf("cannot load schema \"%s\": %s", sch.file, err)
+		}
+	}
+	if err != nil {
+		sch = nil
+	}
+	return
+}
+
+// validate returns a *schemaErrorType if the specified body does not conform
+// to the schema
+func (sch *schemaType) validate(body string) (err error) {
+	res, valErr := sch.schema.Validate(gojsonschema.NewStringLoader(body))
+	switch {
+	case valErr != nil:
+		err = &schemaErrorType{pattern: sch.pattern, list: []string{"body is not valid JSON"}}
+	case !res.Valid():
+		e := &schemaErrorType{pattern: sch.pattern}
+		for _, desc := range res.Errors() {
+			if len(e.list) < schemaErrorsMax {
+				e.list = append(e.list, desc.String())
+			}
+		}
+		err = e
+	}
+	return
+}
+
+// schemaCheck validates the body of the specified event against every schema
+// of the block whose pattern matches the event's category. Rejections are
+// counted in the block's statistics. A binary body never conforms.
+func (rule *ruleType) schemaCheck(evt eventType) (err error) {
+	for j := 0; j < len(rule.schemas) && err == nil; j++ {
+		sch := rule.schemas[j]
+		if globMatch(sch.pattern, evt.Category) {
+			if evt.Encoding == "" {
+				err = sch.validate(evt.Data)
+			} else {
+				err = &schemaErrorType{pattern: sch.pattern, list: []string{"body is binary"}}
+			}
+		}
+	}
+	if err != nil {
+		rule.manager.invalid()
+	}
+	return
+}
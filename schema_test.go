@@ -0,0 +1,88 @@
+package pubsub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	var err error
+	var dir string
+	var hnd handlerType
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "order.json"), []byte(`{
+	"type": "object",
+	"required": ["id", "amount"],
+	"properties": {
+		"id": {"type": "integer"},
+		"amount": {"$ref": "amount.json"}
+	}
+}`), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "amount.json"), []byte(`{"type": "number", "minimum": 0}`), 0644)
+	}
+	if err == nil {
+		_, err = schemaParse([]string{"orders.*", filepath.Join(dir, "missing.json")})
+		if err == nil {
+			err = fmt.Errorf("expected error for missing schema file")
+		} else {
+			err = nil
+		}
+	}
+	if err == nil {
+		hnd, err = handlerGet(`pubsub /publish /subscribe {
+	schema orders.* `+filepath.Join(dir, "order.json")+`
+	transform rename raw.* orders.{1}
+	stats_path /stats
+}`, "./test")
+	}
+	if err == nil {
+		defer hnd.shutdown()
+		list := []struct {
+			category, body string
+			code           int
+			text           string
+		}{
+			{"orders.new", `{"id":7,"amount":12.5}`, 200, "OK"},
+			{"orders.new", `{"id":"7","amount":-1}`, 422, "amount: Must be greater than or equal to 0"},
+			{"orders.new", `{"amount":1}`, 422, "id is required"},
+			{"orders.new", `not json`, 422, "not valid JSON"},
+			{"news", `not json`, 200, "OK"},
+			// Validation applies to the category after transforms
+			{"raw.new", `not json`, 422, "not valid JSON"},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			item := list[j]
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, httptest.NewRequest("POST", "/publish?category="+item.category+"&body="+
+				strings.Replace(item.body, " ", "+", -1), nil))
+			if rec.Code != item.code || !strings.Contains(rec.Body.String(), item.text) {
+				err = fmt.Errorf("%d: unexpected response %d %s", j, rec.Code, rec.Body.String())
+			}
+		}
+	}
+	if err == nil {
+		if _, ok := hnd.rules[0].ingest(eventNew("raw.new", "not json")).(*schemaErrorType); !ok {
+			err = fmt.Errorf("expected schema error for renamed event")
+		}
+	}
+	if err == nil {
+		st := hnd.rules[0].manager.snapshot()
+		if st.Invalid != 5 || st.Published != 2 {
+			err = fmt.Errorf("unexpected statistics %+v", st)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Number of events that can wait for delivery to a sink
+const sinkQueueLen = 1000
+
+// sinkType receives a copy of every event that a manager dispatches, for
+// delivery outside of the subscription paths
+type sinkType interface {
+	// accept queues the specified event. It is called with the manager
+	// mutex held, so it must not block or call back into the manager.
+	accept(evt eventType)
+	// stop ends delivery. Queued events are discarded.
+	stop()
+}
+
+// globMatch returns true if the specified category matches the specified
+// pattern in its entirety. In the pattern, "*" matches any sequence of
+// characters, including an empty one, and "?" matches any single character.
+// Other characters match themselves.
+func globMatch(pattern, category string) bool {
+	// Position in each string to resume from after the most recent "*"
+	star, resume := -1, 0
+	p, c := 0, 0
+	for c < len(category) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == category[c]):
+			p++
+			c++
+		case p < len(pattern) && pattern[p] == '*':
+			star, resume = p, c
+			p++
+		case star >= 0:
+			resume++
+			p, c = star+1, resume
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// optionsParse interprets arguments of the form key=value. The value of each
+// key is passed to the specified function, which returns an error if the key
+// or value is invalid.
+func optionsParse(args []string, fnc func(key, val string) error) (err error) {
+	for j := 0; j < len(args) && err == nil; j++ {
+		pos := strings.Index(args[j], "=")
+		if pos > 0 {
+			err = fnc(args[j][:pos], args[j][pos+1:])
+		} else {
+			err = fmt.Errorf("expecting option of the form key=value, got \"%s\"", args[j])
+		}
+	}
+	return
+}
+
+// poolType is a queue of events served by a fixed number of workers. Sinks
+// embed it to deliver events without blocking the manager.
+type poolType struct {
+	manager *managerType
+	queue   chan eventType
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// start launches the specified number of workers, each of which passes
+// queued events to fnc one at a time until the pool is stopped
+func (pl *poolType) start(m *managerType, count int, fnc func(evt eventType)) {
+	pl.manager = m
+	pl.queue = make(chan eventType, sinkQueueLen)
+	pl.quit = make(chan struct{})
+	for j := 0; j < count; j++ {
+		go func() {
+			for {
+				select {
+				case evt := <-pl.queue:
+					fnc(evt)
+				case <-pl.quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// enqueue adds the specified event to the queue. It returns false if the
+// queue is full.
+func (pl *poolType) enqueue(evt eventType) (ok bool) {
+	select {
+	case pl.queue <- evt:
+		ok = true
+	default:
+	}
+	return
+}
+
+// stop satisfies the sinkType interface
+func (pl *poolType) stop() {
+	pl.once.Do(func() { close(pl.quit) })
+}
+
+// stopped returns a channel that is closed when the pool is stopped
+func (pl *poolType) stopped() <-chan struct{} {
+	return pl.quit
+}
+
+// deadLetter publishes a copy of an event that a sink could not deliver in
+// the manager's dead-letter category. The copy's metadata identifies the
+// original category and event and includes the specified values.
+func (pl *poolType) deadLetter(evt eventType, meta map[string]string) {
+	dl := eventNew(pl.manager.opt.deadLetter, evt.Data)
+	dl.ContentType, dl.Encoding = evt.ContentType, evt.Encoding
+	dl.Meta = make(map[string]string, len(evt.Meta)+len(meta)+2)
+	for k, v := range evt.Meta {
+		dl.Meta[k] = v
+	}
+	dl.Meta["original_category"] = evt.Category
+	dl.Meta["original_id"] = evt.ID
+	for k, v := range meta {
+		dl.Meta[k] = v
+	}
+	pl.manager.dispatch(dl)
+}
+
+// sinkAccepts returns true if a sink with the specified category pattern
+// should receive the specified event. Events addressed to particular clients
+// and events in the dead-letter category are never sent to sinks.
+func sinkAccepts(m *managerType, pattern string, evt eventType) bool {
+	return len(evt.To) == 0 && evt.Category != m.opt.deadLetter && globMatch(pattern, evt.Category)
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"fmt"
+)
+
+// sourceType produces events from outside of the publish path and
+// dispatches them with a manager. Sources are started when the server starts
+// and stopped when it shuts down.
+type sourceType interface {
+	// start begins producing events for the specified manager
+	start(m *managerType) error
+	// stop ends production of events
+	stop()
+}
+
+// sourceParse parses the arguments of a source subdirective. The first
+// argument names the kind of source and the remainder are interpreted by it.
+func sourceParse(args []string) (src sourceType, err error) {
+	if len(args) < 1 {
+		err = fmt.Errorf("expecting at least 1 argument after \"source\", got %d", len(args))
+		return
+	}
+	switch args[0] {
+	case "exec":
+		src, err = execSourceParse(args[1:])
+	default:
+		err = fmt.Errorf("unrecognized source \"%s\"", args[0])
+	}
+	return
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default template of the category in which syslog messages are published
+	syslogCategoryDefault = "logs.{hostname}.{severity}"
+	// Priority of a message that lacks one
+	syslogPriorityDefault = 13
+	// Placeholder value for a field that is missing from a message
+	syslogUnknown = "unknown"
+)
+
+var (
+	errSyslogFrame = errors.New("invalid syslog octet count")
+	errSyslogSD    = errors.New("invalid syslog structured data")
+	syslogFieldRe  = regexp.MustCompile(`\{([a-z_]*)\}`)
+	syslogFields   = map[string]bool{"hostname": true, "severity": true, "facility": true, "app_name": true}
+	syslogSeverity = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+	syslogFacility = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+)
+
+// syslogMessageType is the body of an event published for a syslog message.
+// Fields that are absent from the message are omitted; Version is set only
+// for RFC 5424 messages.
+type syslogMessageType struct {
+	Facility       string                       `json:"facility"`
+	Severity       string                       `json:"severity"`
+	Priority       int                          `json:"priority"`
+	Version        int                          `json:"version,omitempty"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+}
+
+// syslogParse parses the arguments of a syslog subdirective: an address and
+// options of the form key=value. The returned listener receives messages over
+// UDP or TCP and publishes them in categories built from a template.
+func syslogParse(args []string) (ln *listenType, err error) {
+	if len(args) < 1 {
+		err = fmt.Errorf("expecting at least 1 argument after \"syslog\", got %d", len(args))
+		return
+	}
+	template := syslogCategoryDefault
+	ln = &listenType{network: "udp", address: args[0], split: syslogSplit, whole: true}
+	err = optionsParse(args[1:], func(key, val string) (err error) {
+		switch key {
+		case "network":
+			if val == "udp" || val == "tcp" {
+				ln.network = val
+			} else {
+				err = fmt.Errorf("syslog network must be \"udp\" or \"tcp\"")
+			}
+		case "category":
+			template = val
+		default:
+			err = fmt.Errorf("unrecognized syslog option \"%s\"", key)
+		}
+		return
+	})
+	if err == nil {
+		if template == "" || len(template) > categoryLenMax {
+			err = errCategoryLen
+		}
+		for _, match := range syslogFieldRe.FindAllStringSubmatch(template, -1) {
+			if err == nil && !syslogFields[match[1]] {
+				err = fmt.Errorf("unrecognized syslog category field \"%s\"", match[0])
+			}
+		}
+	}
+	if err == nil {
+		ln.parse = func(rec []byte) (evt eventType, err error) {
+			var buf []byte
+			msg := syslogMessage(rec)
+			buf, err = json.Marshal(msg)
+			if err == nil {
+				evt = eventNew(msg.category(template), string(buf))
+			}
+			return
+		}
+	} else {
+		ln = nil
+	}
+	return
+}
+
+// syslogSplit divides a TCP stream into messages. A message is framed either
+// by a preceding octet count and space (RFC 6587 octet counting) or by a
+// trailing newline.
+func syslogSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) > 0 && data[0] >= '0' && data[0] <= '9' {
+		pos := bytes.IndexByte(data, ' ')
+		switch {
+		case pos < 0:
+			if atEOF || len(data) > 8 {
+				err = errSyslogFrame
+			}
+		default:
+			var count int
+			count, err = strconv.Atoi(string(data[:pos]))
+			if err != nil || count < 1 || count > listenRecordMax {
+				err = errSyslogFrame
+			} else if len(data) >= pos+1+count {
+				advance = pos + 1 + count
+				token = data[pos+1 : advance]
+			} else if atEOF {
+				err = errSyslogFrame
+			}
+		}
+		return
+	}
+	return bufio.ScanLines(data, atEOF)
+}
+
+// category returns the category of the message by replacing each field name
+// in braces in the template with the field's value
+func (msg *syslogMessageType) category(template string) string {
+	return syslogFieldRe.ReplaceAllStringFunc(template, func(field string) (val string) {
+		switch field {
+		case "{hostname}":
+			val = msg.Hostname
+		case "{severity}":
+			val = msg.Severity
+		case "{facility}":
+			val = msg.Facility
+		case "{app_name}":
+			val = msg.AppName
+		}
+		if val == "" {
+			val = syslogUnknown
+		}
+		return
+	})
+}
+
+// syslogToken returns the text of str up to the first space and the text
+// after that space. A token of "-" denotes a missing value and is returned as
+// an empty string.
+func syslogToken(str string) (tok, rest string) {
+	pos := strings.IndexByte(str, ' ')
+	if pos < 0 {
+		tok = str
+	} else {
+		tok, rest = str[:pos], str[pos+1:]
+	}
+	if tok == "-" {
+		tok = ""
+	}
+	return
+}
+
+// syslogMessage parses an RFC 5424 or RFC 3164 message. Parsing is lenient:
+// a message that lacks a priority is given the priority user.notice, and
+// text that cannot be parsed as a header becomes part of the message.
+func syslogMessage(rec []byte) (msg syslogMessageType) {
+	str := strings.TrimRight(string(rec), "\r\n\x00")
+	msg.Priority = syslogPriorityDefault
+	if strings.HasPrefix(str, "<") {
+		pos := strings.IndexByte(str, '>')
+		if pos > 1 && pos <= 4 {
+			if pri, err := strconv.Atoi(str[1:pos]); err == nil && pri >= 0 && pri < len(syslogFacility)*8 {
+				msg.Priority = pri
+				str = str[pos+1:]
+			}
+		}
+	}
+	msg.Facility = syslogFacility[msg.Priority/8]
+	msg.Severity = syslogSeverity[msg.Priority%8]
+	if len(str) > 1 && str[0] >= '1' && str[0] <= '9' && str[1] == ' ' {
+		// Fall back to RFC 3164 if the header is malformed
+		full := msg
+		if full.rfc5424(str) == nil {
+			msg = full
+			return
+		}
+	}
+	msg.rfc3164(str)
+	return
+}
+
+// rfc5424 parses the remainder of an RFC 5424 message that follows the
+// priority
+func (msg *syslogMessageType) rfc5424(str string) (err error) {
+	var tok string
+	tok, str = syslogToken(str)
+	msg.Version, _ = strconv.Atoi(tok)
+	msg.Timestamp, str = syslogToken(str)
+	msg.Hostname, str = syslogToken(str)
+	msg.AppName, str = syslogToken(str)
+	msg.ProcID, str = syslogToken(str)
+	msg.MsgID, str = syslogToken(str)
+	msg.StructuredData, str, err = syslogSD(str)
+	if err == nil {
+		msg.Message = strings.TrimPrefix(str, "\xef\xbb\xbf")
+	}
+	return
+}
+
+// rfc3164 parses the remainder of an RFC 3164 message that follows the
+// priority. The timestamp, which lacks a year, is assumed to be in the past
+// year in local time.
+func (msg *syslogMessageType) rfc3164(str string) {
+	const stamp = "Jan _2 15:04:05"
+	if len(str) > len(stamp) && str[len(stamp)] == ' ' {
+		now := time.Now()
+		tm, err := time.ParseInLocation(stamp, str[:len(stamp)], time.Local)
+		if err == nil {
+			tm = tm.AddDate(now.Year(), 0, 0)
+			if tm.After(now.Add(24 * time.Hour)) {
+				tm = tm.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = tm.Format(time.RFC3339)
+			msg.Hostname, str = syslogToken(str[len(stamp)+1:])
+			// The tag, such as "sshd[1234]:", precedes the message content
+			if tok, rest := syslogToken(str); strings.HasSuffix(tok, ":") && len(tok) <= 48 {
+				tok = strings.TrimSuffix(tok, ":")
+				if pos := strings.IndexByte(tok, '['); pos > 0 && strings.HasSuffix(tok, "]") {
+					msg.ProcID = tok[pos+1 : len(tok)-1]
+					tok = tok[:pos]
+				}
+				msg.AppName, str = tok, rest
+			}
+		}
+	}
+	msg.Message = str
+}
+
+// syslogSD parses the structured data that begins str and returns the
+// remaining text. Structured data is either "-" or one or more elements of
+// the form [id name="value" ...].
+func syslogSD(str string) (sd map[string]map[string]string, rest string, err error) {
+	if strings.HasPrefix(str, "-") {
+		rest = strings.TrimPrefix(str[1:], " ")
+		return
+	}
+	sd = make(map[string]map[string]string)
+	for err == nil && strings.HasPrefix(str, "[") {
+		var id string
+		pos := strings.IndexAny(str, " ]")
+		if pos < 2 {
+			err = errSyslogSD
+			break
+		}
+		id, str = str[1:pos], str[pos:]
+		params := make(map[string]string)
+		for err == nil && strings.HasPrefix(str, " ") {
+			var val []byte
+			str = strings.TrimLeft(str, " ")
+			pos = strings.Index(str, "=\"")
+			if pos < 1 {
+				err = errSyslogSD
+				break
+			}
+			name := str[:pos]
+			str = str[pos+2:]
+			for pos = 0; pos < len(str) && str[pos] != '"'; pos++ {
+				if str[pos] == '\\' && pos+1 < len(str) && strings.IndexByte(`"\]`, str[pos+1]) >= 0 {
+					pos++
+				}
+				val = append(val, str[pos])
+			}
+			if pos < len(str) {
+				params[name] = string(val)
+				str = str[pos+1:]
+			} else {
+				err = errSyslogSD
+			}
+		}
+		if err == nil {
+			if strings.HasPrefix(str, "]") {
+				sd[id] = params
+				str = str[1:]
+			} else {
+				err = errSyslogSD
+			}
+		}
+	}
+	if err == nil {
+		if len(str) > 0 && str[0] != ' ' {
+			err = errSyslogSD
+		}
+		rest = strings.TrimPrefix(str, " ")
+	}
+	if err != nil || len(sd) == 0 {
+		sd = nil
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSyslogParse(t *testing.T) {
+	var err error
+	var ln *listenType
+
+	ln, err = syslogParse([]string{"127.0.0.1:5514", "network=tcp", "category=logs.{facility}"})
+	if err == nil && (ln.network != "tcp" || ln.address != "127.0.0.1:5514") {
+		err = fmt.Errorf("unexpected listener %+v", ln)
+	}
+	for _, args := range [][]string{
+		{},
+		{"127.0.0.1:5514", "network=unix"},
+		{"127.0.0.1:5514", "category=logs.{host}"},
+		{"127.0.0.1:5514", "category="},
+		{"127.0.0.1:5514", "format=json"},
+	} {
+		if err == nil {
+			_, err = syslogParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	var err error
+
+	list := []struct {
+		rec, category, str string
+	}{
+		{`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventID="1011"][examplePriority@32473 class="high \"x\""] ` +
+			"\xef\xbb\xbfAn application event log entry...",
+			"logs.mymachine.example.com.notice",
+			`{local4 notice 165 1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog  ID47 ` +
+				`map[examplePriority@32473:map[class:high "x"] exampleSDID@32473:map[eventID:1011 iut:3]] An application event log entry...}`},
+		{"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed\n",
+			"logs.mymachine.example.com.crit",
+			`{auth crit 34 1 2003-10-11T22:14:15.003Z mymachine.example.com su  ID47 map[] 'su root' failed}`},
+		{"<13>Feb  5 17:32:18 10.0.0.99 sshd[1234]: Accepted publickey",
+			"logs.10.0.0.99.notice", ""},
+		{"<27>1 - host app - - [sd oops", "logs.unknown.err", `{daemon err 27 0      map[] 1 - host app - - [sd oops}`},
+		{"plain text", "logs.unknown.notice", `{user notice 13 0      map[] plain text}`},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		item := list[j]
+		msg := syslogMessage([]byte(item.rec))
+		if msg.category(syslogCategoryDefault) != item.category {
+			err = fmt.Errorf("%q: unexpected category %s", item.rec, msg.category(syslogCategoryDefault))
+		} else if item.str != "" {
+			if str := fmt.Sprintf("%v", msg); str != item.str {
+				err = fmt.Errorf("%q: unexpected message %s", item.rec, str)
+			}
+		} else if msg.AppName != "sshd" || msg.ProcID != "1234" || msg.Message != "Accepted publickey" ||
+			!strings.Contains(msg.Timestamp, "-02-05T17:32:18") {
+			err = fmt.Errorf("%q: unexpected message %+v", item.rec, msg)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyslogSplit(t *testing.T) {
+	var list []string
+
+	scanner := bufio.NewScanner(strings.NewReader("10 <13>first\n20 <13>second\nand more\n<13>third\r\n<13>fourth"))
+	scanner.Split(syslogSplit)
+	for scanner.Scan() {
+		list = append(list, scanner.Text())
+	}
+	str := strings.Join(list, "|")
+	if str != "<13>first\n|<13>second\nand more\n|<13>third|<13>fourth" || scanner.Err() != nil {
+		t.Fatalf("unexpected messages %q, %v", str, scanner.Err())
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	var err error
+	var conn net.Conn
+	var evts []eventType
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	rule := ruleType{manager: m}
+	for _, network := range []string{"udp", "tcp"} {
+		var ln *listenType
+		ln, err = syslogParse([]string{"127.0.0.1:0", "network=" + network, "category=" + network + ".{app_name}"})
+		if err == nil {
+			ln.ingest = rule.ingest
+			err = ln.start(m)
+		}
+		if err == nil {
+			defer ln.stop()
+			var address string
+			if network == "udp" {
+				address = ln.packet.LocalAddr().String()
+			} else {
+				address = ln.listener.Addr().String()
+			}
+			conn, err = net.Dial(network, address)
+		}
+		if err == nil {
+			_, err = conn.Write([]byte("<11>1 - host app - - - first\nline\n"))
+			conn.Close()
+		}
+		if err == nil {
+			evts = listenEvents(m, network+".app", 1)
+			if network == "tcp" {
+				evts = append(evts, listenEvents(m, network+".unknown", 1)...)
+			}
+			if len(evts) == 0 || !strings.Contains(evts[0].Data, `"message":"first`) ||
+				network == "udp" && !strings.Contains(evts[0].Data, `"message":"first\nline"`) ||
+				network == "tcp" && (len(evts) != 2 || !strings.Contains(evts[1].Data, `"message":"line"`)) {
+				err = fmt.Errorf("%s: unexpected events %+v", network, evts)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errDropped = errors.New("event dropped by transform")
+	// Placeholders in a rename template
+	renameFieldRe = regexp.MustCompile(`\{(category|[1-9])\}`)
+)
+
+// renameType maps categories that match a pattern to new categories
+type renameType struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// transformType is a single step of the transformation pipeline that is
+// applied to events published in a block
+type transformType struct {
+	// One of "rename", "timestamp", "publisher", "redact" or "drop"
+	kind   string
+	rename renameType
+	// The field or metadata key that is set or removed
+	target filterTermType
+	// The events that are dropped
+	filter filterType
+}
+
+// globRegexp returns a regular expression equivalent to a category pattern.
+// Each "*" in the pattern becomes a capturing group.
+func globRegexp(pattern string) *regexp.Regexp {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for _, ch := range pattern {
+		switch ch {
+		case '*':
+			buf.WriteString("(.*)")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.MustCompile(buf.String())
+}
+
+// renameParse returns a rename from categories that match the specified
+// pattern to the specified template. In the template, {category} stands for
+// the original category and {1}, {2} and so on for the text matched by each
+// "*" of the pattern.
+func renameParse(pattern, template string) (rn renameType, err error) {
+	rn = renameType{re: globRegexp(pattern), template: template}
+	stars := strings.Count(pattern, "*")
+	for _, match := range renameFieldRe.FindAllStringSubmatch(template, -1) {
+		if n, convErr := strconv.Atoi(match[1]); convErr == nil && n > stars && err == nil {
+			err = fmt.Errorf("template refers to \"%s\" but the pattern has %d wildcards", match[0], stars)
+		}
+	}
+	return
+}
+
+// apply returns the category that results from renaming the specified
+// category and whether the category matches the pattern. A category that
+// does not match is returned unchanged.
+func (rn renameType) apply(category string) (out string, ok bool) {
+	groups := rn.re.FindStringSubmatch(category)
+	ok = groups != nil
+	if !ok || rn.template == "" {
+		return category, ok
+	}
+	out = renameFieldRe.ReplaceAllStringFunc(rn.template, func(field string) string {
+		if field == "{category}" {
+			return category
+		}
+		n, _ := strconv.Atoi(field[1 : len(field)-1])
+		return groups[n]
+	})
+	return
+}
+
+// targetParse parses the field or metadata key that a transform sets or
+// removes, using the path syntax of filters
+func targetParse(str string) (term filterTermType, err error) {
+	var f filterType
+	f, err = filterParse(str)
+	if err == nil && (len(f) != 1 || f[0].op != "" || !f[0].meta && len(f[0].path) == 0) {
+		err = fmt.Errorf("expecting a field such as data.name or meta.key, got \"%s\"", str)
+	}
+	if err == nil {
+		term = f[0]
+	}
+	return
+}
+
+// transformParse parses the arguments of a transform subdirective
+func transformParse(args []string) (tr transformType, err error) {
+	argCount := len(args)
+	if argCount < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"transform\", got %d", argCount)
+		return
+	}
+	tr.kind = args[0]
+	switch tr.kind {
+	case "rename":
+		if argCount == 3 {
+			tr.rename, err = renameParse(args[1], args[2])
+		} else {
+			err = fmt.Errorf("expecting a pattern and template after \"transform rename\", got %d arguments", argCount-1)
+		}
+	case "timestamp", "publisher", "redact":
+		if argCount == 2 {
+			tr.target, err = targetParse(args[1])
+		} else {
+			err = fmt.Errorf("expecting 1 argument after \"transform %s\", got %d", tr.kind, argCount-1)
+		}
+	case "drop":
+		tr.filter, err = filterParse(strings.Join(args[1:], " "))
+	default:
+		err = fmt.Errorf("unrecognized transform \"%s\"", tr.kind)
+	}
+	return
+}
+
+// jsonEdit decodes a JSON object and passes it to fnc, which returns true if
+// it modifies the object. The modified object is returned re-encoded, with
+// numbers keeping their original text. If str is not a JSON object or is not
+// modified, it is returned unchanged.
+func jsonEdit(str string, fnc func(obj map[string]interface{}) bool) string {
+	var obj map[string]interface{}
+	var buf bytes.Buffer
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.UseNumber()
+	if dec.Decode(&obj) == nil && obj != nil && fnc(obj) {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if enc.Encode(obj) == nil {
+			str = strings.TrimSuffix(buf.String(), "\n")
+		}
+	}
+	return str
+}
+
+// metaCopy returns a copy of the specified metadata that can be modified
+func metaCopy(meta map[string]string) map[string]string {
+	cp := make(map[string]string, len(meta)+1)
+	for k, v := range meta {
+		cp[k] = v
+	}
+	return cp
+}
+
+// set stores the specified value at the target of a transform. Objects are
+// created as needed along the path of a body field, but a value that is not
+// an object is never replaced by one. Binary bodies are left unchanged.
+func (tr transformType) set(evt *eventType, val interface{}) (err error) {
+	if tr.target.meta {
+		meta := metaCopy(evt.Meta)
+		err = metaSet(meta, tr.target.path[0], fmt.Sprint(val))
+		if err == nil {
+			evt.Meta = meta
+		}
+	} else if evt.Encoding == "" {
+		path := tr.target.path
+		evt.Data = jsonEdit(evt.Data, func(obj map[string]interface{}) bool {
+			for _, name := range path[:len(path)-1] {
+				next, ok := obj[name].(map[string]interface{})
+				if !ok {
+					if _, exists := obj[name]; exists {
+						return false
+					}
+					next = make(map[string]interface{})
+					obj[name] = next
+				}
+				obj = next
+			}
+			obj[path[len(path)-1]] = val
+			return true
+		})
+	}
+	return
+}
+
+// remove deletes the target of a transform if it is present. Binary bodies
+// are left unchanged.
+func (tr transformType) remove(evt *eventType) {
+	if tr.target.meta {
+		if _, ok := evt.Meta[tr.target.path[0]]; ok {
+			meta := metaCopy(evt.Meta)
+			delete(meta, tr.target.path[0])
+			if len(meta) == 0 {
+				meta = nil
+			}
+			evt.Meta = meta
+		}
+	} else if evt.Encoding == "" {
+		path := tr.target.path
+		evt.Data = jsonEdit(evt.Data, func(obj map[string]interface{}) bool {
+			for _, name := range path[:len(path)-1] {
+				next, ok := obj[name].(map[string]interface{})
+				if !ok {
+					return false
+				}
+				obj = next
+			}
+			_, ok := obj[path[len(path)-1]]
+			delete(obj, path[len(path)-1])
+			return ok
+		})
+	}
+}
+
+// transform applies the block's transforms, in the order they were
+// configured, to an event that is about to be published. The specified user
+// is the authenticated publisher, if any. errDropped is returned if a
+// transform drops the event. The result is checked against the block's
+// limits.
+func (rule *ruleType) transform(evt eventType, user string) (out eventType, err error) {
+	for j := 0; j < len(rule.transforms) && err == nil; j++ {
+		tr := rule.transforms[j]
+		switch tr.kind {
+		case "rename":
+			evt.Category, _ = tr.rename.apply(evt.Category)
+		case "timestamp":
+			err = tr.set(&evt, msec(time.Now()))
+		case "publisher":
+			if user != "" {
+				err = tr.set(&evt, user)
+			}
+		case "redact":
+			tr.remove(&evt)
+		case "drop":
+			if tr.filter.match(evt) {
+				err = errDropped
+			}
+		}
+	}
+	if err == nil && len(rule.transforms) > 0 {
+		err = rule.eventCheck(evt)
+	}
+	if err == nil {
+		out = evt
+	}
+	return
+}
+
+// ingest validates, transforms and dispatches an event that enters the block
+// other than through a publish path. An event that is dropped by a transform
+// is discarded without error.
+func (rule *ruleType) ingest(evt eventType) error {
+	return rule.admit(evt, false)
+}
+
+// ingestTrusted is like ingest, but the event, forwarded from another block,
+// keeps any value under the block's publisher metadata key
+func (rule *ruleType) ingestTrusted(evt eventType) error {
+	return rule.admit(evt, true)
+}
+
+// admit validates, transforms and dispatches an event for ingest and
+// ingestTrusted
+func (rule *ruleType) admit(evt eventType, trusted bool) (err error) {
+	err = rule.recordCheck(evt, trusted)
+	if err == nil {
+		evt, err = rule.transform(evt, "")
+	}
+	if err == nil {
+		err = rule.schemaCheck(evt)
+	}
+	if err == nil {
+		_, err = rule.manager.dispatch(evt)
+	} else if err == errDropped {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestTransformParse(t *testing.T) {
+	var err error
+
+	for _, args := range [][]string{
+		{"rename"},
+		{"rename", "raw.*"},
+		{"rename", "raw.*", "clean.{2}"},
+		{"timestamp", "received"},
+		{"timestamp", "data"},
+		{"redact", "data.a", "data.b"},
+		{"drop", "level==debug"},
+		{"shuffle", "data.a"},
+	} {
+		if err == nil {
+			_, err = transformParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	for _, args := range [][]string{
+		{"rename", "raw.*.*", "clean.{2}.{1}"},
+		{"timestamp", "meta.received"},
+		{"publisher", "data.source.user"},
+		{"drop", "data.level==debug", "&&", "meta.env==test"},
+	} {
+		if err == nil {
+			_, err = transformParse(args)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	var err error
+	var hnd handlerType
+	var evts []eventType
+	var body map[string]interface{}
+
+	hnd, err = handlerGet(`pubsub /publish /subscribe {
+	transform drop data.level==debug
+	transform rename raw.* clean.{1}
+	transform redact data.password
+	transform redact data.user.ssn
+	transform redact meta.token
+	transform timestamp data.received
+	transform publisher meta.publisher
+}`, "./test")
+	if err == nil {
+		defer hnd.shutdown()
+		list := []struct {
+			category, body string
+			dropped        bool
+		}{
+			{"raw.orders", `{"level":"debug"}`, true},
+			{"raw.orders", `{"user":{"name":"ann","ssn":"123"},"password":"x","amount":1.50,"note":"<b>"}`, false},
+			{"news", "plain text", false},
+		}
+		for j := 0; j < len(list) && err == nil; j++ {
+			item := list[j]
+			form := url.Values{"category": {item.category}, "body": {item.body}, "meta.token": {"secret"}}
+			r := httptest.NewRequest("POST", "/publish", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = r.WithContext(context.WithValue(r.Context(), httpserver.RemoteUserCtxKey, "ann"))
+			rec := httptest.NewRecorder()
+			hnd.ServeHTTP(rec, r)
+			if rec.Code != 200 || (rec.Header().Get("Pubsub-Dropped") == "true") != item.dropped ||
+				(rec.Header().Get("Pubsub-Id") == "") != item.dropped {
+				err = fmt.Errorf("%d: unexpected response %d %v", j, rec.Code, rec.Header())
+			}
+		}
+	}
+	if err == nil {
+		m := hnd.rules[0].manager
+		evts = listenEvents(m, "clean.orders", 1)
+		if len(evts) != 1 || evts[0].Meta["publisher"] != "ann" || evts[0].Meta["token"] != "" {
+			err = fmt.Errorf("unexpected events %+v", evts)
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(evts[0].Data), &body)
+		}
+		if err == nil && (body["password"] != nil || body["received"] == nil || body["note"] != "<b>" ||
+			fmt.Sprint(body["user"]) != "map[name:ann]" || !strings.Contains(evts[0].Data, `"amount":1.50`)) {
+			err = fmt.Errorf("unexpected body %s", evts[0].Data)
+		}
+		if err == nil {
+			// Bodies that are not JSON objects pass through unchanged
+			evts = listenEvents(m, "news", 1)
+			if len(evts) != 1 || evts[0].Data != "plain text" {
+				err = fmt.Errorf("unexpected events %+v", evts)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Default period of quiet after a change to a path before it is published
+const watchDebounceDefault = 500 * time.Millisecond
+
+// watchChangeType is the body of an event published for a filesystem change
+type watchChangeType struct {
+	// One of "create", "write", "remove" or "rename"
+	Change string `json:"change"`
+	Path   string `json:"path"`
+}
+
+// watchType publishes an event whenever a watched file or directory changes.
+// Changes to a path are debounced: an event is published only once the path
+// has been quiet for the debounce period, and it reports the most recent
+// change.
+type watchType struct {
+	path      string
+	category  string
+	debounce  time.Duration
+	recursive bool
+	// Validates, transforms and dispatches changes
+	ingest  func(evt eventType) error
+	watcher *fsnotify.Watcher
+	mutex   sync.Mutex
+	// Most recent unpublished change by path
+	pending map[string]string
+	timers  map[string]*time.Timer
+	done    chan struct{}
+}
+
+// watchParse parses the arguments of a watch subdirective: a path, a
+// category and options of the form key=value
+func watchParse(args []string) (wt *watchType, err error) {
+	if len(args) < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"watch\", got %d", len(args))
+		return
+	}
+	wt = &watchType{category: args[1], debounce: watchDebounceDefault}
+	wt.path, err = filepath.Abs(args[0])
+	if err == nil && (len(wt.category) == 0 || len(wt.category) > categoryLenMax) {
+		err = errCategoryLen
+	}
+	if err == nil {
+		err = optionsParse(args[2:], func(key, val string) (err error) {
+			switch key {
+			case "debounce":
+				wt.debounce, err = durationParse(val)
+				if err == nil && wt.debounce < 0 {
+					err = fmt.Errorf("watch debounce must not be negative")
+				}
+			case "recursive":
+				wt.recursive, err = strconv.ParseBool(val)
+			default:
+				err = fmt.Errorf("unrecognized watch option \"%s\"", key)
+			}
+			return
+		})
+	}
+	if err != nil {
+		wt = nil
+	}
+	return
+}
+
+// add watches the specified path and, if the watch is recursive and the path
+// is a directory, every directory beneath it
+func (wt *watchType) add(path string) (err error) {
+	err = wt.watcher.Add(path)
+	if err == nil && wt.recursive {
+		err = filepath.Walk(path, func(sub string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() && sub != path {
+				err = wt.watcher.Add(sub)
+			}
+			return err
+		})
+	}
+	return
+}
+
+// start satisfies the sourceType interface
+func (wt *watchType) start(m *managerType) (err error) {
+	wt.pending = make(map[string]string)
+	wt.timers = make(map[string]*time.Timer)
+	wt.done = make(chan struct{})
+	wt.watcher, err = fsnotify.NewWatcher()
+	if err == nil {
+		err = wt.add(wt.path)
+		if err == nil {
+			go wt.run()
+		} else {
+			wt.watcher.Close()
+			wt.watcher = nil
+		}
+	}
+	return
+}
+
+// stop satisfies the sourceType interface. Changes not yet published are
+// discarded.
+func (wt *watchType) stop() {
+	if wt.watcher != nil {
+		wt.watcher.Close()
+		<-wt.done
+		wt.mutex.Lock()
+		for path, tmr := range wt.timers {
+			tmr.Stop()
+			delete(wt.timers, path)
+		}
+		wt.mutex.Unlock()
+	}
+}
+
+// changeName returns the name of the most significant operation in op
+func changeName(op fsnotify.Op) (name string) {
+	switch {
+	case op&fsnotify.Remove != 0:
+		name = "remove"
+	case op&fsnotify.Rename != 0:
+		name = "rename"
+	case op&fsnotify.Create != 0:
+		name = "create"
+	case op&fsnotify.Write != 0:
+		name = "write"
+	}
+	return
+}
+
+// run receives filesystem notifications until the watcher is closed
+func (wt *watchType) run() {
+	defer close(wt.done)
+	for {
+		select {
+		case ev, ok := <-wt.watcher.Events:
+			if !ok {
+				return
+			}
+			if change := changeName(ev.Op); change != "" {
+				if change == "create" && wt.recursive {
+					if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+						wt.add(ev.Name)
+					}
+				}
+				wt.note(ev.Name, change)
+			}
+		case _, ok := <-wt.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// note records a change to the specified path and restarts its debounce
+// timer. A path that is created and then written within the period is
+// reported as created.
+func (wt *watchType) note(path, change string) {
+	wt.mutex.Lock()
+	if !(change == "write" && wt.pending[path] == "create") {
+		wt.pending[path] = change
+	}
+	if tmr, ok := wt.timers[path]; ok {
+		tmr.Stop()
+	}
+	wt.timers[path] = time.AfterFunc(wt.debounce, func() { wt.flush(path) })
+	wt.mutex.Unlock()
+}
+
+// flush publishes the pending change to the specified path
+func (wt *watchType) flush(path string) {
+	wt.mutex.Lock()
+	change, ok := wt.pending[path]
+	delete(wt.pending, path)
+	delete(wt.timers, path)
+	wt.mutex.Unlock()
+	if ok {
+		buf, _ := json.Marshal(watchChangeType{Change: change, Path: path})
+		evt := eventNew(wt.category, string(buf))
+		evt.Meta = map[string]string{"change": change, "path": path}
+		wt.ingest(evt)
+	}
+}
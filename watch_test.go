@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchParse(t *testing.T) {
+	var err error
+	var wt *watchType
+
+	wt, err = watchParse([]string{"/var/spool/jobs", "files", "debounce=2", "recursive=true"})
+	if err == nil && (wt.path != "/var/spool/jobs" || wt.category != "files" || wt.debounce != 2*time.Second || !wt.recursive) {
+		err = fmt.Errorf("unexpected watch %+v", wt)
+	}
+	for _, args := range [][]string{
+		{"/var/spool/jobs"},
+		{"/var/spool/jobs", "files", "debounce=soon"},
+		{"/var/spool/jobs", "files", "recursive=maybe"},
+		{"/var/spool/jobs", "files", "depth=2"},
+	} {
+		if err == nil {
+			_, err = watchParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var err error
+	var dir string
+	var wt *watchType
+	var res eventResponseType
+
+	dir, err = ioutil.TempDir("", "pubsub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	wt, err = watchParse([]string{dir, "files", "debounce=50ms", "recursive=true"})
+	if err == nil {
+		rule := ruleType{manager: m}
+		wt.ingest = rule.ingest
+		err = wt.start(m)
+	}
+	if err == nil {
+		defer wt.stop()
+		sub := filepath.Join(dir, "sub")
+		err = os.Mkdir(sub, 0755)
+		if err == nil {
+			// Allow the new directory to be watched
+			time.Sleep(200 * time.Millisecond)
+			name := filepath.Join(sub, "a.txt")
+			for j := 0; j < 5 && err == nil; j++ {
+				err = ioutil.WriteFile(name, []byte("abc"), 0644)
+			}
+		}
+	}
+	if err == nil {
+		var change watchChangeType
+		for j := 0; j < 100 && len(res.Events) < 2; j++ {
+			time.Sleep(10 * time.Millisecond)
+			rec := httptest.NewRecorder()
+			m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=1&category=files&since_time=0", nil))
+			json.Unmarshal(rec.Body.Bytes(), &res)
+		}
+		if len(res.Events) != 2 {
+			err = fmt.Errorf("expected 2 events, got %d", len(res.Events))
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(res.Events[1].Data), &change)
+		}
+		if err == nil && (change.Change != "create" || change.Path != filepath.Join(dir, "sub", "a.txt") ||
+			res.Events[1].Meta["change"] != "create") {
+			err = fmt.Errorf("unexpected change %+v", change)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
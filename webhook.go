@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2019 Kurt Jung (Gmail: kurt.w.jung)
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package pubsub
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default number of concurrent requests to a webhook target
+	webhookConcurrencyDefault = 4
+	// Default number of attempts to deliver an event to a webhook
+	webhookAttemptsDefault = 5
+	// Default delay before the first retry; it doubles with each retry
+	webhookBackoffDefault = time.Second
+	// Maximum delay between retries
+	webhookBackoffMax = time.Minute
+	// Default time limit of a single webhook request
+	webhookTimeoutDefault = 10 * time.Second
+)
+
+// webhookType delivers the events of matching categories to a URL with HTTP
+// POST requests
+type webhookType struct {
+	poolType
+	pattern     string
+	url         string
+	secret      string
+	concurrency int
+	attempts    int
+	backoff     time.Duration
+	client      *http.Client
+	// Limit shared with other webhooks that deliver to the same URL
+	target *webhookTargetType
+}
+
+// webhookTargetType limits the number of requests in progress to a URL
+// across every webhook that delivers to it, so that two subdirectives with
+// the same URL do not double the load on the endpoint
+type webhookTargetType struct {
+	cond   *sync.Cond
+	active int
+	// Concurrency of each webhook that delivers to the URL; the smallest
+	// applies
+	users map[*webhookType]int
+}
+
+var (
+	// Guards webhookTargets and the fields of each target
+	webhookMutex sync.Mutex
+	// Targets of started webhooks by URL
+	webhookTargets = make(map[string]*webhookTargetType)
+)
+
+// webhookParse parses the arguments of a webhook subdirective: a category
+// pattern, a URL and options of the form key=value
+func webhookParse(args []string) (wh *webhookType, err error) {
+	if len(args) < 2 {
+		err = fmt.Errorf("expecting at least 2 arguments after \"webhook\", got %d", len(args))
+		return
+	}
+	wh = &webhookType{
+		pattern:     args[0],
+		url:         args[1],
+		concurrency: webhookConcurrencyDefault,
+		attempts:    webhookAttemptsDefault,
+		backoff:     webhookBackoffDefault,
+		client:      &http.Client{Timeout: webhookTimeoutDefault},
+	}
+	var u *url.URL
+	u, err = url.Parse(wh.url)
+	if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		err = fmt.Errorf("webhook URL must be an absolute http or https URL, got \"%s\"", wh.url)
+	}
+	if err == nil {
+		err = optionsParse(args[2:], func(key, val string) (err error) {
+			switch key {
+			case "secret":
+				wh.secret = val
+			case "concurrency":
+				wh.concurrency, err = strconv.Atoi(val)
+				if err == nil && wh.concurrency < 1 {
+					err = fmt.Errorf("webhook concurrency must be at least 1")
+				}
+			case "attempts":
+				wh.attempts, err = strconv.Atoi(val)
+				if err == nil && wh.attempts < 1 {
+					err = fmt.Errorf("webhook attempts must be at least 1")
+				}
+			case "backoff":
+				wh.backoff, err = durationParse(val)
+				if err == nil && wh.backoff <= 0 {
+					err = fmt.Errorf("webhook backoff must be positive")
+				}
+			case "timeout":
+				wh.client.Timeout, err = durationParse(val)
+				if err == nil && wh.client.Timeout <= 0 {
+					err = fmt.Errorf("webhook timeout must be positive")
+				}
+			default:
+				err = fmt.Errorf("unrecognized webhook option \"%s\"", key)
+			}
+			return
+		})
+	}
+	if err != nil {
+		wh = nil
+	}
+	return
+}
+
+// start begins delivering events dispatched by the specified manager
+func (wh *webhookType) start(m *managerType) {
+	webhookMutex.Lock()
+	tgt, ok := webhookTargets[wh.url]
+	if !ok {
+		tgt = &webhookTargetType{cond: sync.NewCond(&webhookMutex), users: make(map[*webhookType]int)}
+		webhookTargets[wh.url] = tgt
+	}
+	tgt.users[wh] = wh.concurrency
+	wh.target = tgt
+	webhookMutex.Unlock()
+	wh.poolType.start(m, wh.concurrency, wh.deliver)
+}
+
+// stop ends delivery and releases the webhook's share of its target
+func (wh *webhookType) stop() {
+	wh.poolType.stop()
+	webhookMutex.Lock()
+	delete(wh.target.users, wh)
+	if len(wh.target.users) == 0 && webhookTargets[wh.url] == wh.target {
+		delete(webhookTargets, wh.url)
+	}
+	// The limit may have risen
+	wh.target.cond.Broadcast()
+	webhookMutex.Unlock()
+}
+
+// limit returns the number of requests allowed in progress to the target.
+// webhookMutex must be held.
+func (tgt *webhookTargetType) limit() (n int) {
+	for _, count := range tgt.users {
+		if n == 0 || count < n {
+			n = count
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	return
+}
+
+// acquire waits until a request to the target can begin
+func (tgt *webhookTargetType) acquire() {
+	webhookMutex.Lock()
+	for tgt.active >= tgt.limit() {
+		tgt.cond.Wait()
+	}
+	tgt.active++
+	webhookMutex.Unlock()
+}
+
+// release marks the end of a request to the target
+func (tgt *webhookTargetType) release() {
+	webhookMutex.Lock()
+	tgt.active--
+	tgt.cond.Broadcast()
+	webhookMutex.Unlock()
+}
+
+// accept satisfies the sinkType interface. If the queue is full, the event is
+// dead-lettered at once.
+func (wh *webhookType) accept(evt eventType) {
+	if sinkAccepts(wh.manager, wh.pattern, evt) && !wh.enqueue(evt) {
+		go wh.deadLetter(evt, map[string]string{"webhook": wh.url, "attempts": "0", "error": "delivery queue full"})
+	}
+}
+
+// signature returns the hexadecimal HMAC-SHA256 of the specified body keyed
+// with the webhook's secret
+func (wh *webhookType) signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(wh.secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post makes a single attempt to deliver the specified JSON-encoded event
+func (wh *webhookType) post(evt eventType, body []byte) (err error) {
+	var req *http.Request
+	var resp *http.Response
+	req, err = http.NewRequest("POST", wh.url, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Pubsub-Id", evt.ID)
+		req.Header.Set("Pubsub-Category", evt.Category)
+		if wh.secret != "" {
+			req.Header.Set("Pubsub-Signature", "sha256="+wh.signature(body))
+		}
+		resp, err = wh.client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+			}
+		}
+	}
+	return
+}
+
+// deliver attempts to deliver the specified event, retrying with exponential
+// backoff. If every attempt fails, the event is dead-lettered.
+func (wh *webhookType) deliver(evt eventType) {
+	var err error
+	body, _ := json.Marshal(evt)
+	delay := wh.backoff
+	attempt := 0
+	stopped := false
+	for !stopped {
+		attempt++
+		wh.target.acquire()
+		err = wh.post(evt, body)
+		wh.target.release()
+		if err == nil || attempt >= wh.attempts {
+			break
+		}
+		tmr := time.NewTimer(delay)
+		select {
+		case <-tmr.C:
+		case <-wh.stopped():
+			tmr.Stop()
+			stopped = true
+		}
+		delay *= 2
+		if delay > webhookBackoffMax {
+			delay = webhookBackoffMax
+		}
+	}
+	if err != nil && !stopped {
+		wh.deadLetter(evt, map[string]string{
+			"webhook":  wh.url,
+			"attempts": strconv.Itoa(attempt),
+			"error":    err.Error(),
+		})
+	}
+}
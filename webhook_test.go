@@ -0,0 +1,195 @@
+package pubsub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	var err error
+	list := []struct {
+		pattern, category string
+		match             bool
+	}{
+		{"*", "anything", true},
+		{"*", "", true},
+		{"orders", "orders", true},
+		{"orders", "orders.new", false},
+		{"orders.*", "orders.new", true},
+		{"orders.*", "orders", false},
+		{"*.new", "orders.new", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+	}
+	for j := 0; j < len(list) && err == nil; j++ {
+		if globMatch(list[j].pattern, list[j].category) != list[j].match {
+			err = fmt.Errorf("%s %s: expected %v", list[j].pattern, list[j].category, list[j].match)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookParse(t *testing.T) {
+	var err error
+	var wh *webhookType
+
+	wh, err = webhookParse([]string{"orders.*", "https://example.com/hook", "secret=s3cret", "concurrency=2",
+		"attempts=3", "backoff=2s", "timeout=5"})
+	if err == nil && (wh.secret != "s3cret" || wh.concurrency != 2 || wh.attempts != 3 ||
+		wh.backoff != 2*time.Second || wh.client.Timeout != 5*time.Second) {
+		err = fmt.Errorf("unexpected webhook %+v", wh)
+	}
+	for _, args := range [][]string{
+		{"orders"},
+		{"orders", "example.com/hook"},
+		{"orders", "https://example.com/hook", "concurrency=0"},
+		{"orders", "https://example.com/hook", "colour=blue"},
+		{"orders", "https://example.com/hook", "secret"},
+	} {
+		if err == nil {
+			_, err = webhookParse(args)
+			if err == nil {
+				err = fmt.Errorf("%v: expected error", args)
+			} else {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var err error
+	var calls, active, peak int32
+	var res eventResponseType
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("key"))
+		mac.Write(body)
+		var evt eventType
+		json.Unmarshal(body, &evt)
+		switch {
+		case r.Header.Get("Pubsub-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)):
+			w.WriteHeader(http.StatusUnauthorized)
+		case evt.Data == "fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case evt.Data == "flaky" && atomic.AddInt32(&calls, 1) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	var wh *webhookType
+	wh, err = webhookParse([]string{"jobs.*", srv.URL, "secret=key", "concurrency=2", "attempts=3", "backoff=10ms"})
+	if err == nil {
+		wh.start(m)
+		m.sinks = append(m.sinks, wh)
+		for j := 0; j < 6 && err == nil; j++ {
+			_, err = m.publish("jobs.new", "ok")
+		}
+		for _, body := range []string{"flaky", "fail"} {
+			if err == nil {
+				_, err = m.publish("jobs.new", body)
+			}
+		}
+		if err == nil {
+			_, err = m.publish("other", "fail")
+		}
+	}
+	if err == nil {
+		// Only the event that fails every attempt is dead-lettered
+		rec := httptest.NewRecorder()
+		m.subscriptionHandler(rec, httptest.NewRequest("GET", "/subscribe?timeout=5&category=dead_letter&since_time=0", nil))
+		err = json.Unmarshal(rec.Body.Bytes(), &res)
+		if err == nil && (len(res.Events) != 1 || res.Events[0].Meta["attempts"] != "3" ||
+			res.Events[0].Meta["original_category"] != "jobs.new") {
+			err = fmt.Errorf("unexpected dead letters %s", rec.Body.String())
+		}
+	}
+	if err == nil && atomic.LoadInt32(&peak) > 2 {
+		err = fmt.Errorf("expected at most 2 concurrent requests, got %d", peak)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookShared(t *testing.T) {
+	var err error
+	var active, peak, calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	m := managerGet(t, optionsType{})
+	defer m.shutdown()
+	// Two subdirectives with the same URL share the smaller limit
+	for _, args := range [][]string{{"a.*", srv.URL, "concurrency=2"}, {"b.*", srv.URL, "concurrency=3"}} {
+		var wh *webhookType
+		if err == nil {
+			wh, err = webhookParse(args)
+			if err == nil {
+				wh.start(m)
+				m.sinks = append(m.sinks, wh)
+			}
+		}
+	}
+	for j := 0; j < 8 && err == nil; j++ {
+		_, err = m.publish("a.x", "ok")
+		if err == nil {
+			_, err = m.publish("b.x", "ok")
+		}
+	}
+	if err == nil {
+		for j := 0; j < 200 && atomic.LoadInt32(&calls) < 16; j++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		switch {
+		case atomic.LoadInt32(&calls) != 16:
+			err = fmt.Errorf("expected 16 deliveries, got %d", calls)
+		case atomic.LoadInt32(&peak) > 2:
+			err = fmt.Errorf("expected at most 2 concurrent requests, got %d", peak)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}